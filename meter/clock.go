@@ -0,0 +1,64 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock is used to read the current time and to wait for time to elapse. It
+// can be replaced to simulate the passage of time in tests and replay tools.
+type Clock interface {
+
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel which receives the current time once the given
+	// duration has elapsed.
+	After(time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock backed by the time package which is used unless
+// another clock is configured.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// ClockSetter is implemented by meters and handlers which need to read the
+// time. The Poller sets its clock on the meters when they are added and on the
+// handlers when they are registered.
+type ClockSetter interface {
+	SetClock(Clock)
+}
+
+// clockRef holds a clock which can be replaced while it's being used and which
+// defaults to SystemClock.
+type clockRef struct {
+	value atomic.Value
+}
+
+// clockBox gives a consistent concrete type to the values of clockRef.
+type clockBox struct{ Clock }
+
+func (ref *clockRef) Set(clock Clock) {
+	ref.value.Store(clockBox{clock})
+}
+
+func (ref *clockRef) Get() Clock {
+	if box, ok := ref.value.Load().(clockBox); ok && box.Clock != nil {
+		return box.Clock
+	}
+	return SystemClock
+}
+
+// Now forwards the call to the current clock such that a clockRef can be used
+// as a Clock which follows the calls to Set.
+func (ref *clockRef) Now() time.Time { return ref.Get().Now() }
+
+// After forwards the call to the current clock.
+func (ref *clockRef) After(d time.Duration) <-chan time.Time { return ref.Get().After(d) }
@@ -4,6 +4,7 @@ package meter_test
 
 import (
 	"github.com/datacratic/gometer/meter"
+	"github.com/datacratic/gometer/meter/metertest"
 
 	"fmt"
 	"sort"
@@ -80,6 +81,12 @@ func ExampleMeter() {
 	handler := func(values map[string]float64) { resultC <- values }
 	meter.Handle(meter.HandlerFunc(handler))
 
+	// The values are normalized using the time elapsed since the meters were
+	// last polled so, to keep the example's output deterministic, the polls
+	// are timed using a fake clock instead of the system clock.
+	clock := metertest.NewClock(metertest.Epoch)
+	meter.DefaultPoller.Clock = clock
+
 	// Meter polling must be initiated via the Poll function.
 	meter.Poll("myProcess", 1*time.Second)
 
@@ -88,6 +95,9 @@ func ExampleMeter() {
 	component.Init()
 	component.Exec()
 
+	// Time only moves when the fake clock is advanced.
+	clock.Advance(1 * time.Second)
+
 	// Finally, we'll finish off the test by reading the value and printing them
 	// out.
 	SortAndPrint(<-resultC)
@@ -99,9 +109,9 @@ func ExampleMeter() {
 	// myProcess.myComponent.Histogram.count: 100.000000
 	// myProcess.myComponent.Histogram.max: 99.000000
 	// myProcess.myComponent.Histogram.min: 0.000000
-	// myProcess.myComponent.Histogram.p50: 50.000000
-	// myProcess.myComponent.Histogram.p90: 90.000000
-	// myProcess.myComponent.Histogram.p99: 99.000000
+	// myProcess.myComponent.Histogram.p50: 49.500000
+	// myProcess.myComponent.Histogram.p90: 89.100000
+	// myProcess.myComponent.Histogram.p99: 98.010000
 	// myProcess.myComponent.Multi.Counter.error: 1.000000
 	// myProcess.myComponent.Multi.Counter.success: 1.000000
 	// myProcess.myComponent.State.happy: 1.000000
@@ -2,14 +2,36 @@
 
 package meter
 
-import ()
+import (
+	"context"
+)
 
 // Handler is used to periodically process the aggregated values of multiple
-// meters.
+// meters. Every handler receives its own copy of the values which it's free to
+// keep or modify without affecting the other handlers. Handlers which are meant
+// to rewrite the values seen by other handlers should also implement Transformer
+// in which case the Poller applies them as transformers.
 type Handler interface {
 	HandleMeters(map[string]float64)
 }
 
+// SampleHandler is implemented by handlers which can make use of the metadata
+// associated with the meter values. HandleSamples is called instead of
+// HandleMeters while other handlers receive the values with their labels
+// flattened into the keys. The slice of samples belongs to the handler but the
+// labels of the samples are shared and should not be modified.
+type SampleHandler interface {
+	Handler
+	HandleSamples([]Sample)
+}
+
+// Flusher is implemented by handlers which buffer values before sending them.
+// Flush blocks until all the values received by the handler were processed or
+// until the context is done in which case the context's error is returned.
+type Flusher interface {
+	Flush(context.Context) error
+}
+
 // HandlerFunc is used to wrap a function as a Handler interface.
 type HandlerFunc func(map[string]float64)
 
@@ -17,3 +39,19 @@ type HandlerFunc func(map[string]float64)
 func (fn HandlerFunc) HandleMeters(values map[string]float64) {
 	fn(values)
 }
+
+// Transformer is used to rewrite the polled samples before they are dispatched
+// to the handlers. Transformers are applied in order and the samples returned
+// by the last one are seen by every handler. The given samples should not be
+// modified; a transformer must return a new slice instead.
+type Transformer interface {
+	Transform([]Sample) []Sample
+}
+
+// TransformerFunc is used to wrap a function as a Transformer interface.
+type TransformerFunc func([]Sample) []Sample
+
+// Transform forwards the call to the wrapped function.
+func (fn TransformerFunc) Transform(samples []Sample) []Sample {
+	return fn(samples)
+}
@@ -6,35 +6,133 @@ import (
 	"github.com/datacratic/goklog/klog"
 
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 var (
-	// CarbonDialTimeout is the timeout value when dialing the remote carbon
-	// host.
+	// CarbonDialTimeout is used as the value of DialTimeout in CarbonHandler
+	// if no values are provided.
 	CarbonDialTimeout = 1 * time.Second
 
-	// CarbonMaxConnDelay is the maximum value of the exponential backoff scheme
-	// when reconecting to a carbon host.
+	// CarbonWriteTimeout is used as the value of WriteTimeout in CarbonHandler
+	// if no values are provided.
+	CarbonWriteTimeout = 10 * time.Second
+
+	// CarbonMaxConnDelay is used as the value of MaxConnDelay in CarbonHandler
+	// if no values are provided.
 	CarbonMaxConnDelay = 1 * time.Minute
 )
 
+// DefaultCarbonQueueSize is used if QueueSize is not set in CarbonHandler.
+const DefaultCarbonQueueSize = 64
+
+// DefaultCarbonPacketSize is the maximum size of a datagram sent to a carbon
+// host over UDP.
+const DefaultCarbonPacketSize = 1432
+
 // CarbonHandler forwards a set of recorded meter values to multiple carbon
-// hosts. Any values received while the connection to the carbon host is
-// unavailable are dropped.
+// hosts.
+//
+// Each carbon host has its own bounded queue of values which is consumed by a
+// dedicated go-routine such that a slow or unavailable host doesn't block the
+// poller or the other hosts. Values which can't be queued are spooled if
+// SpoolDir is set and dropped otherwise.
+//
+// Values received while the connection to a carbon host is unavailable are
+// dropped unless SpoolDir is set in which case they are written to disk and
+// replayed with their original timestamp once the connection is back.
+//
+// Values are sent as Graphite tagged series if either Rules or Tags are set in
+// which case labels are also sent as tags. Otherwise labels are flattened into
+// the keys.
 type CarbonHandler struct {
 
-	// URLs contains the list of carbon hosts to connect to.
+	// URLs contains the list of carbon hosts to connect to. The scheme of the
+	// URL selects the protocol used to talk to the host: tcp://host:2003 (the
+	// default if no scheme is given) and udp://host:2003 use the plaintext
+	// protocol while pickle://host:2004 uses the batched pickle protocol over
+	// TCP. An optional carbon instance name can be given as the fragment of
+	// the URL (eg. pickle://host:2004#a) which is only used for consistent
+	// hashing.
 	URLs []string
 
+	// ConsistentHashing routes each key to ReplicationFactor hosts instead of
+	// sending every key to every host. Hosts are selected using the same
+	// consistent hashing scheme as carbon-relay (carbon_ch) such that a
+	// sharded carbon cluster can be fed without going through a relay.
+	ConsistentHashing bool
+
+	// ReplicationFactor is the number of hosts that receive each key when
+	// ConsistentHashing is set. Defaults to 1.
+	ReplicationFactor int
+
+	// DiverseReplicas ensures that the replicas of a key are sent to distinct
+	// servers when ConsistentHashing is set by skipping the instances located
+	// on a server which was already selected. This should match the
+	// DIVERSE_REPLICAS setting of the carbon-relay being replaced.
+	DiverseReplicas bool
+
+	// Rules are applied in order to the keys and the first matching rule
+	// determines the name and the tags of the Graphite tagged series (eg.
+	// name;tag=value) associated with the key. Keys which don't match any rule
+	// are used as is for the name.
+	Rules []TagRule
+
+	// Tags are added to every series (eg. host or datacenter).
+	Tags map[string]string
+
+	// TLSConfig enables TLS for the connections to the carbon hosts when set.
+	// NewTLSConfig can be used to configure client certificates and custom
+	// certificate authorities. TLS is not supported for UDP hosts.
+	TLSConfig *tls.Config
+
+	// QueueSize is the maximum number of polled batches of values that can be
+	// queued for each carbon host. Defaults to DefaultCarbonQueueSize.
+	QueueSize int
+
+	// SpoolDir is the optional directory where values are spooled while a
+	// carbon host is unavailable. Each carbon host is spooled to its own file
+	// which is replayed when the handler is restarted.
+	SpoolDir string
+
+	// SpoolMaxSize is the maximum size in bytes of the spool of each carbon
+	// host above which values are dropped. Defaults to DefaultCarbonSpoolSize.
+	SpoolMaxSize int64
+
+	// DialTimeout is the timeout value when dialing a carbon host. Defaults
+	// to CarbonDialTimeout.
+	DialTimeout time.Duration
+
+	// WriteTimeout is the timeout value when writing to a carbon host.
+	// Defaults to CarbonWriteTimeout.
+	WriteTimeout time.Duration
+
+	// MaxConnDelay is the maximum value of the exponential backoff scheme
+	// when reconnecting to a carbon host. Defaults to CarbonMaxConnDelay.
+	MaxConnDelay time.Duration
+
 	initialize sync.Once
+	closer     sync.Once
+
+	hosts []*carbonHost
+	ring  *carbonRing
+	clock clockRef
+}
 
-	conns   map[string]net.Conn
-	connC   chan msgConn
-	valuesC chan map[string]float64
+// SetClock sets the clock used to delay reconnection attempts and to timestamp
+// the values passed to HandleMeters. Note that the write deadlines of the
+// connections are always based on the system clock.
+func (carbon *CarbonHandler) SetClock(clock Clock) {
+	carbon.clock.Set(clock)
 }
 
 // NewCarbonHandler instantiates a new CarbonHandler which will log to the given
@@ -49,109 +147,475 @@ func (carbon *CarbonHandler) Init() {
 	carbon.initialize.Do(carbon.init)
 }
 
-// HandleMeters forwards the given values to all the carbon host with a valid
-// connection.
-func (carbon *CarbonHandler) HandleMeters(values map[string]float64) {
-	carbon.Init()
-	carbon.valuesC <- values
-}
-
-type msgConn struct {
-	URL  string
-	Conn net.Conn
-}
-
 func (carbon *CarbonHandler) init() {
 	if len(carbon.URLs) == 0 {
 		klog.KFatal("meter.carbon.init.error", "no URL configured")
 	}
 
-	carbon.connC = make(chan msgConn)
-	carbon.valuesC = make(chan map[string]float64)
+	if carbon.QueueSize == 0 {
+		carbon.QueueSize = DefaultCarbonQueueSize
+	}
+
+	if carbon.SpoolMaxSize == 0 {
+		carbon.SpoolMaxSize = DefaultCarbonSpoolSize
+	}
+
+	if carbon.ReplicationFactor == 0 {
+		carbon.ReplicationFactor = 1
+	}
+
+	if carbon.DialTimeout == 0 {
+		carbon.DialTimeout = CarbonDialTimeout
+	}
+
+	if carbon.WriteTimeout == 0 {
+		carbon.WriteTimeout = CarbonWriteTimeout
+	}
+
+	if carbon.MaxConnDelay == 0 {
+		carbon.MaxConnDelay = CarbonMaxConnDelay
+	}
+
+	var nodes []carbonNode
 
-	carbon.conns = make(map[string]net.Conn)
 	for _, URL := range carbon.URLs {
-		carbon.connect(URL)
+		host := &carbonHost{
+			URL:    URL,
+			queueC: make(chan []carbonMetric, carbon.QueueSize),
+			flushC: make(chan chan struct{}),
+			stopC:  make(chan struct{}),
+			doneC:  make(chan struct{}),
+			clock:  &carbon.clock,
+
+			dialTimeout:  carbon.DialTimeout,
+			writeTimeout: carbon.WriteTimeout,
+			maxConnDelay: carbon.MaxConnDelay,
+		}
+
+		var err error
+		var instance string
+
+		if host.scheme, host.addr, instance, err = parseCarbonURL(URL); err != nil {
+			klog.KFatalf("meter.carbon.init.error", "invalid URL '%s': %s", URL, err)
+		}
+
+		if carbon.TLSConfig != nil {
+			if host.scheme == "udp" {
+				klog.KFatalf("meter.carbon.init.error", "TLS is not supported for UDP URL '%s'", URL)
+			}
+			host.tls = carbon.TLSConfig
+		}
+
+		server, _, err := net.SplitHostPort(host.addr)
+		if err != nil {
+			server = host.addr
+		}
+		nodes = append(nodes, carbonNode{Server: server, Instance: instance})
+
+		if carbon.SpoolDir != "" {
+			host.spool = newCarbonSpool(carbon.SpoolDir, URL, carbon.SpoolMaxSize)
+		}
+
+		carbon.hosts = append(carbon.hosts, host)
+		go host.run()
 	}
 
-	go carbon.run()
+	if carbon.ConsistentHashing {
+		var err error
+		if carbon.ring, err = newCarbonRing(nodes); err != nil {
+			klog.KFatalf("meter.carbon.init.error", "invalid consistent hashing ring: %s", err)
+		}
+	}
 }
 
-func (carbon *CarbonHandler) run() {
-	for {
+// HandleMeters forwards the given values to all the carbon hosts.
+func (carbon *CarbonHandler) HandleMeters(values map[string]float64) {
+	carbon.HandleSamples(newSamples(values, &carbon.clock))
+}
+
+// HandleSamples queues the given samples to be forwarded to all the carbon
+// hosts. The samples are timestamped with the time at which they were polled.
+func (carbon *CarbonHandler) HandleSamples(samples []Sample) {
+	carbon.Init()
+
+	metrics := make([]carbonMetric, 0, len(samples))
+	for _, sample := range samples {
+		metrics = append(metrics, carbonMetric{
+			Path:  carbon.path(sample),
+			Value: sample.Value,
+			Time:  sample.Timestamp.Unix(),
+		})
+	}
+
+	if carbon.ring == nil {
+		for _, host := range carbon.hosts {
+			host.queue(metrics)
+		}
+		return
+	}
+
+	routed := make([][]carbonMetric, len(carbon.hosts))
+
+	for _, metric := range metrics {
+		nodes := carbon.ring.Nodes(metric.Path, carbon.ReplicationFactor)
+		if carbon.DiverseReplicas {
+			nodes = carbon.ring.DiverseNodes(metric.Path, carbon.ReplicationFactor)
+		}
+
+		for _, node := range nodes {
+			routed[node] = append(routed[node], metric)
+		}
+	}
+
+	for node, host := range carbon.hosts {
+		if len(routed[node]) > 0 {
+			host.queue(routed[node])
+		}
+	}
+}
+
+// Flush blocks until all the values queued by the handler were either sent to
+// the carbon hosts, spooled or dropped or until the context is done. Flush is
+// called by Poller.Stop.
+func (carbon *CarbonHandler) Flush(ctx context.Context) error {
+	carbon.Init()
+
+	for _, host := range carbon.hosts {
+		doneC := make(chan struct{})
+
+		select {
+		case host.flushC <- doneC:
+		case <-host.doneC:
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
 		select {
-		case values := <-carbon.valuesC:
-			carbon.send(values)
+		case <-doneC:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Close stops the go-routines of the carbon hosts and closes their
+// connections. Values still queued are spooled if SpoolDir is set and dropped
+// otherwise so Flush should be called first. Values passed to the handler after
+// Close are never sent.
+func (carbon *CarbonHandler) Close() {
+	carbon.Init()
+
+	carbon.closer.Do(func() {
+		for _, host := range carbon.hosts {
+			close(host.stopC)
+		}
+
+		for _, host := range carbon.hosts {
+			<-host.doneC
+		}
+	})
+}
+
+// path returns the carbon path of the given sample which is either the
+// flattened key of the sample or a tagged series.
+func (carbon *CarbonHandler) path(sample Sample) string {
+	if len(carbon.Rules) == 0 && len(carbon.Tags) == 0 {
+		return sample.FlatKey()
+	}
+
+	name, tags := applyTagRules(carbon.Rules, sample.Key)
 
-		case msg := <-carbon.connC:
-			carbon.conns[msg.URL] = msg.Conn
+	for label, value := range sample.Labels {
+		tags[label] = value
+	}
+
+	for tag, value := range carbon.Tags {
+		if _, ok := tags[tag]; !ok {
+			tags[tag] = value
 		}
 	}
+
+	return carbonSeries(name, tags)
+}
+
+type carbonMetric struct {
+	Path  string
+	Value float64
+	Time  int64
+}
+
+type carbonHost struct {
+	URL string
+
+	scheme string
+	addr   string
+	tls    *tls.Config
+
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+	maxConnDelay time.Duration
+
+	queueC chan []carbonMetric
+	flushC chan chan struct{}
+	stopC  chan struct{}
+	doneC  chan struct{}
+
+	conn     net.Conn
+	attempts int
+	nextDial time.Time
+	clock    *clockRef
+
+	spool *carbonSpool
 }
 
-func (carbon *CarbonHandler) connect(URL string) {
+func (host *carbonHost) queue(metrics []carbonMetric) {
+	select {
+	case host.queueC <- metrics:
+		return
+	default:
+	}
 
-	if conn := carbon.conns[URL]; conn != nil {
-		conn.Close()
+	if host.spool == nil {
+		klog.KPrintf("meter.carbon.queue.error", "queue full for '%s': dropping %d values", host.URL, len(metrics))
+		return
 	}
-	carbon.conns[URL] = nil
 
-	go carbon.dial(URL)
+	klog.KPrintf("meter.carbon.queue.error", "queue full for '%s': spooling %d values", host.URL, len(metrics))
+	host.spoolMetrics(metrics)
+}
+
+func (host *carbonHost) run() {
+	defer close(host.doneC)
+
+	for {
+		select {
+		case <-host.stopC:
+			for {
+				select {
+				case metrics := <-host.queueC:
+					host.spoolMetrics(metrics)
+				default:
+					host.disconnect()
+					return
+				}
+			}
+
+		case metrics := <-host.queueC:
+			host.send(metrics)
+
+		case doneC := <-host.flushC:
+			for drained := false; !drained; {
+				select {
+				case metrics := <-host.queueC:
+					host.send(metrics)
+				default:
+					drained = true
+				}
+			}
+			close(doneC)
+		}
+	}
 }
 
-func (carbon *CarbonHandler) dial(URL string) {
-	for attempts := 0; ; attempts++ {
-		carbon.sleep(attempts)
+func (host *carbonHost) send(metrics []carbonMetric) {
+	if !host.connect() {
+		host.spoolMetrics(metrics)
+		return
+	}
 
-		conn, err := net.DialTimeout("tcp", URL, CarbonDialTimeout)
-		if err == nil {
-			klog.KPrintf("meter.carbon.dial.info", "connected to '%s'", URL)
-			carbon.connC <- msgConn{URL, conn}
+	if host.spool != nil && host.spool.Len() > 0 {
+		if err := host.spool.Replay(host.write); err != nil {
+			klog.KPrintf("meter.carbon.replay.error", "error when replaying to '%s': %s", host.URL, err)
+			host.disconnect()
+			host.spoolMetrics(metrics)
 			return
 		}
+	}
 
-		klog.KPrintf("meter.carbon.dial.error", "unable to connect to '%s': %s", URL, err)
+	if err := host.write(metrics); err != nil {
+		klog.KPrintf("meter.carbon.send.error", "error when sending to '%s': %s", host.URL, err)
+		host.disconnect()
+		host.spoolMetrics(metrics)
 	}
 }
 
-func (carbon *CarbonHandler) sleep(attempts int) {
-	if attempts == 0 {
+func (host *carbonHost) spoolMetrics(metrics []carbonMetric) {
+	if host.spool == nil {
 		return
 	}
 
-	sleepFor := time.Duration(attempts*2) * time.Second
+	if err := host.spool.Write(metrics); err != nil {
+		klog.KPrintf("meter.carbon.spool.error", "unable to spool values for '%s': %s", host.URL, err)
+	}
+}
+
+func (host *carbonHost) connect() bool {
+	if host.conn != nil {
+		return true
+	}
+
+	if host.clock.Get().Now().Before(host.nextDial) {
+		return false
+	}
+
+	conn, err := host.dial()
+	if err != nil {
+		klog.KPrintf("meter.carbon.dial.error", "unable to connect to '%s': %s", host.URL, err)
 
-	if sleepFor < CarbonMaxConnDelay {
-		time.Sleep(sleepFor)
-	} else {
-		time.Sleep(CarbonMaxConnDelay)
+		host.attempts++
+		host.nextDial = host.clock.Get().Now().Add(host.backoff())
+		return false
 	}
+
+	klog.KPrintf("meter.carbon.dial.info", "connected to '%s'", host.URL)
+
+	host.conn = conn
+	host.attempts = 0
+	return true
 }
 
-func (carbon *CarbonHandler) send(values map[string]float64) {
-	ts := time.Now().Unix()
+func (host *carbonHost) dial() (net.Conn, error) {
+	if host.scheme == "udp" {
+		return net.DialTimeout("udp", host.addr, host.dialTimeout)
+	}
+
+	if host.tls != nil {
+		dialer := &net.Dialer{Timeout: host.dialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", host.addr, host.tls)
+	}
 
-	for URL, conn := range carbon.conns {
-		if conn == nil {
-			continue
+	return net.DialTimeout("tcp", host.addr, host.dialTimeout)
+}
+
+func (host *carbonHost) disconnect() {
+	if host.conn != nil {
+		host.conn.Close()
+		host.conn = nil
+	}
+}
+
+func (host *carbonHost) backoff() time.Duration {
+	sleepFor := time.Duration(host.attempts*2) * time.Second
+
+	if sleepFor < host.maxConnDelay {
+		return sleepFor
+	}
+	return host.maxConnDelay
+}
+
+func (host *carbonHost) write(metrics []carbonMetric) error {
+	host.conn.SetWriteDeadline(time.Now().Add(host.writeTimeout))
+
+	switch host.scheme {
+
+	case "pickle":
+		for i := 0; i < len(metrics); i += carbonPickleBatch {
+			j := i + carbonPickleBatch
+			if j > len(metrics) {
+				j = len(metrics)
+			}
+
+			if _, err := host.conn.Write(encodePickle(metrics[i:j])); err != nil {
+				return err
+			}
 		}
 
-		if err := carbon.write(conn, values, ts); err != nil {
-			klog.KPrintf("meter.carbon.send.error", "error when sending to '%s': %s", URL, err)
-			carbon.connect(URL)
+	case "udp":
+		var lines []string
+		for _, metric := range metrics {
+			lines = append(lines, strings.TrimSuffix(carbonLine(metric), "\n"))
 		}
+
+		for _, packet := range packLines(lines, DefaultCarbonPacketSize-1) {
+			if _, err := host.conn.Write(append(packet, '\n')); err != nil {
+				return err
+			}
+		}
+
+	default:
+		writer := bufio.NewWriter(host.conn)
+
+		for _, metric := range metrics {
+			if _, err := writer.WriteString(carbonLine(metric)); err != nil {
+				return err
+			}
+		}
+
+		return writer.Flush()
 	}
+
+	return nil
 }
 
-func (carbon *CarbonHandler) write(conn net.Conn, values map[string]float64, ts int64) (err error) {
-	writer := bufio.NewWriter(conn)
+// carbonLine formats the given value using the plaintext protocol. Values are
+// formatted with the minimum number of digits required to represent them
+// exactly.
+func carbonLine(metric carbonMetric) string {
+	value := strconv.FormatFloat(metric.Value, 'g', -1, 64)
+	return metric.Path + " " + value + " " + strconv.FormatInt(metric.Time, 10) + "\n"
+}
 
-	for key, value := range values {
-		if _, err = fmt.Fprintf(writer, "%s %f %d\n", key, value, ts); err != nil {
-			return
+// parseCarbonURL returns the scheme, the address and the instance name of a
+// carbon URL where URLs without a scheme default to tcp.
+func parseCarbonURL(URL string) (scheme, addr, instance string, err error) {
+	if !strings.Contains(URL, "://") {
+		URL = "tcp://" + URL
+	}
+
+	parsed, err := url.Parse(URL)
+	if err != nil {
+		return
+	}
+
+	switch parsed.Scheme {
+	case "tcp", "udp", "pickle":
+	default:
+		err = fmt.Errorf("unsupported scheme '%s'", parsed.Scheme)
+		return
+	}
+
+	return parsed.Scheme, parsed.Host, parsed.Fragment, nil
+}
+
+// carbonSeries formats a Graphite tagged series where tags are sorted by name.
+// Characters which are not allowed by the Graphite tag syntax are replaced by
+// underscores and tags with empty names or values are skipped.
+func carbonSeries(name string, tags map[string]string) string {
+	var names []string
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+
+	series := carbonEscape(name, ";")
+	if series == "" {
+		series = "_"
+	}
+
+	for _, tag := range names {
+		key, value := carbonEscape(tag, ";!^="), carbonEscape(tags[tag], ";")
+		if key == "" || value == "" {
+			continue
+		}
+
+		if value[0] == '~' {
+			value = "_" + value[1:]
 		}
+
+		series += ";" + key + "=" + value
 	}
 
-	err = writer.Flush()
-	return
+	return series
+}
+
+func carbonEscape(str, special string) string {
+	return strings.Map(func(c rune) rune {
+		if c <= ' ' || c == 0x7f || strings.ContainsRune(special, c) {
+			return '_'
+		}
+		return c
+	}, str)
 }
@@ -0,0 +1,68 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// carbonPickleBatch is the maximum number of values sent in a single pickle
+// message.
+const carbonPickleBatch = 500
+
+// Pickle opcodes used to encode carbon messages with protocol 2.
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleLong1      = 0x8a
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleStop       = '.'
+)
+
+// encodePickle encodes the given values as a carbon pickle message which is a
+// pickled list of (path, (timestamp, value)) tuples prefixed with its length as
+// a 4 bytes big-endian integer.
+func encodePickle(metrics []carbonMetric) []byte {
+	buffer := new(bytes.Buffer)
+	buffer.Write([]byte{0, 0, 0, 0})
+
+	buffer.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+
+	for _, metric := range metrics {
+		buffer.WriteByte(pickleBinUnicode)
+		binary.Write(buffer, binary.LittleEndian, uint32(len(metric.Path)))
+		buffer.WriteString(metric.Path)
+
+		pickleInt(buffer, metric.Time)
+
+		buffer.WriteByte(pickleBinFloat)
+		binary.Write(buffer, binary.BigEndian, math.Float64bits(metric.Value))
+
+		buffer.Write([]byte{pickleTuple2, pickleTuple2})
+	}
+
+	buffer.Write([]byte{pickleAppends, pickleStop})
+
+	msg := buffer.Bytes()
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)-4))
+
+	return msg
+}
+
+func pickleInt(buffer *bytes.Buffer, value int64) {
+	if value >= math.MinInt32 && value <= math.MaxInt32 {
+		buffer.WriteByte(pickleBinInt)
+		binary.Write(buffer, binary.LittleEndian, int32(value))
+		return
+	}
+
+	buffer.Write([]byte{pickleLong1, 8})
+	binary.Write(buffer, binary.LittleEndian, value)
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"crypto/md5"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// carbonRingReplicas is the number of positions of each node on the ring.
+const carbonRingReplicas = 100
+
+type carbonRingEntry struct {
+	position int
+	node     int
+}
+
+// carbonRing is a port of the ConsistentHashRing used by carbon-relay with the
+// carbon_ch hash type such that keys are routed to the same carbon hosts as
+// they would be by a relay configured with the same destinations.
+type carbonRing struct {
+	entries []carbonRingEntry
+	servers []string
+}
+
+// carbonNode identifies a destination of carbon-relay. Note that the port is
+// not part of the identity of a node.
+type carbonNode struct {
+	Server   string
+	Instance string
+}
+
+// Key returns the key of a node on the ring which carbon-relay derives from the
+// python representation of the (server, instance) tuple of a destination.
+func (node carbonNode) Key() string {
+	if node.Instance == "" {
+		return "('" + node.Server + "', None)"
+	}
+	return "('" + node.Server + "', '" + node.Instance + "')"
+}
+
+func newCarbonRing(nodes []carbonNode) (*carbonRing, error) {
+	ring := &carbonRing{}
+	positions := make(map[int]bool)
+
+	seen := make(map[string]bool)
+
+	for node, info := range nodes {
+		key := info.Key()
+		ring.servers = append(ring.servers, info.Server)
+
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate node '%s' in ring", key)
+		}
+		seen[key] = true
+
+		for i := 0; i < carbonRingReplicas; i++ {
+			position := carbonRingPosition(key + ":" + strconv.Itoa(i))
+			for positions[position] {
+				position++
+			}
+			positions[position] = true
+
+			ring.entries = append(ring.entries, carbonRingEntry{position, node})
+		}
+	}
+
+	sort.Slice(ring.entries, func(i, j int) bool {
+		return ring.entries[i].position < ring.entries[j].position
+	})
+
+	return ring, nil
+}
+
+// Nodes returns up to n distinct nodes responsible for the given key in the
+// order in which they are found on the ring.
+func (ring *carbonRing) Nodes(key string, n int) []int {
+	return ring.nodes(key, n, false)
+}
+
+// DiverseNodes is similar to Nodes except that nodes located on a server which
+// was already selected are skipped such that the key is replicated across up
+// to n distinct servers. This matches the DIVERSE_REPLICAS setting of
+// carbon-relay.
+func (ring *carbonRing) DiverseNodes(key string, n int) []int {
+	return ring.nodes(key, n, true)
+}
+
+func (ring *carbonRing) nodes(key string, n int, diverse bool) []int {
+	if n > len(ring.servers) {
+		n = len(ring.servers)
+	}
+
+	position := carbonRingPosition(key)
+	index := sort.Search(len(ring.entries), func(i int) bool {
+		return ring.entries[i].position >= position
+	}) % len(ring.entries)
+
+	nodes := make([]int, 0, n)
+
+	for i := 0; i < len(ring.entries) && len(nodes) < n; i++ {
+		node := ring.entries[(index+i)%len(ring.entries)].node
+
+		found := false
+		for _, other := range nodes {
+			found = found || other == node || (diverse && ring.servers[other] == ring.servers[node])
+		}
+
+		if !found {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+// carbonRingPosition returns the position of a key on the ring which is the
+// first 16 bits of its md5 hash.
+func carbonRingPosition(key string) int {
+	sum := md5.Sum([]byte(key))
+	return int(sum[0])<<8 | int(sum[1])
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultCarbonSpoolSize is used if SpoolMaxSize is not set in CarbonHandler.
+const DefaultCarbonSpoolSize = 64 * 1024 * 1024
+
+// carbonSpoolBatch is the number of spooled values sent in a single write when
+// replaying the spool.
+const carbonSpoolBatch = 1000
+
+// carbonSpool persists values in the carbon plaintext format so that they can
+// be replayed later. Replaying values more than once is harmless as carbon
+// keeps the last value written for a given path and timestamp. Values can be
+// spooled by the poller when the queue of a host is full while the host is
+// replaying the spool.
+type carbonSpool struct {
+	path    string
+	maxSize int64
+
+	mutex sync.Mutex
+	size  int64
+}
+
+func newCarbonSpool(dir, URL string, maxSize int64) *carbonSpool {
+	name := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-':
+			return c
+		}
+		return '_'
+	}, URL)
+
+	spool := &carbonSpool{
+		path:    filepath.Join(dir, name+".spool"),
+		maxSize: maxSize,
+	}
+
+	if info, err := os.Stat(spool.path); err == nil {
+		spool.size = info.Size()
+	}
+
+	return spool
+}
+
+// Len returns the number of bytes currently spooled.
+func (spool *carbonSpool) Len() int64 {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	return spool.size
+}
+
+// Write appends the given values to the spool. Values are dropped and an error
+// is returned if the spool is full.
+func (spool *carbonSpool) Write(metrics []carbonMetric) error {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	if spool.size >= spool.maxSize {
+		return fmt.Errorf("spool '%s' is full: dropping %d values", spool.path, len(metrics))
+	}
+
+	file, err := os.OpenFile(spool.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+
+	for _, metric := range metrics {
+		n, err := writer.WriteString(carbonLine(metric))
+
+		spool.size += int64(n)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// Replay reads back the spooled values in batches and passes them to the given
+// function. The spool is only discarded once all the values were successfully
+// replayed. Values can't be spooled while the spool is being replayed.
+func (spool *carbonSpool) Replay(fn func([]carbonMetric) error) error {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	file, err := os.Open(spool.path)
+	if os.IsNotExist(err) {
+		spool.size = 0
+		return nil
+
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var metrics []carbonMetric
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		metric, ok := parseCarbonMetric(scanner.Text())
+		if !ok {
+			continue
+		}
+
+		if metrics = append(metrics, metric); len(metrics) < carbonSpoolBatch {
+			continue
+		}
+
+		if err := fn(metrics); err != nil {
+			return err
+		}
+		metrics = metrics[:0]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(metrics) > 0 {
+		if err := fn(metrics); err != nil {
+			return err
+		}
+	}
+
+	spool.size = 0
+	return os.Remove(spool.path)
+}
+
+func parseCarbonMetric(line string) (metric carbonMetric, ok bool) {
+	i := strings.LastIndex(line, " ")
+	if i < 0 {
+		return
+	}
+
+	j := strings.LastIndex(line[:i], " ")
+	if j < 0 {
+		return
+	}
+
+	var err error
+
+	if metric.Value, err = strconv.ParseFloat(line[j+1:i], 64); err != nil {
+		return
+	}
+
+	if metric.Time, err = strconv.ParseInt(line[i+1:], 10, 64); err != nil {
+		return
+	}
+
+	metric.Path = line[:j]
+	return metric, true
+}
@@ -4,8 +4,13 @@ package meter
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,10 +28,13 @@ func TestCarbonHandler(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	CarbonDialTimeout = 10 * time.Millisecond
-	CarbonMaxConnDelay = 100 * time.Millisecond
-	handler := &CarbonHandler{URLs: []string{c0.URL, c1.URL}}
+	handler := &CarbonHandler{
+		URLs:         []string{c0.URL, c1.URL},
+		DialTimeout:  10 * time.Millisecond,
+		MaxConnDelay: 100 * time.Millisecond,
+	}
 	handler.Init()
+	defer handler.Close()
 
 	CarbonSend("init", handler, c0, c1)
 
@@ -45,6 +53,354 @@ func TestCarbonHandler(t *testing.T) {
 
 	c0.Start()
 	CarbonSend("start-c0", handler, c0, c1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	if err := handler.Flush(ctx); err != nil {
+		t.Errorf("FAIL: unable to flush: %s", err)
+	}
+}
+
+func TestCarbonHandler_Spool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meter-carbon-spool")
+	if err != nil {
+		t.Fatalf("FATAL: unable to create spool dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c0 := &TestCarbon{T: t, Name: "spool"}
+	c0.Init()
+
+	handler := &CarbonHandler{
+		URLs:         []string{c0.URL},
+		SpoolDir:     dir,
+		DialTimeout:  10 * time.Millisecond,
+		MaxConnDelay: 100 * time.Millisecond,
+	}
+	defer handler.Close()
+
+	CarbonSend("init", handler, c0)
+
+	c0.Stop()
+
+	for i := 0; i < 3; i++ {
+		handler.HandleMeters(map[string]float64{"x": 1})
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	if err := handler.Flush(ctx); err != nil {
+		t.Fatalf("FAIL: unable to flush: %s", err)
+	}
+
+	if size := handler.hosts[0].spool.Len(); size == 0 {
+		t.Errorf("FAIL: no values were spooled")
+	}
+
+	c0.Start()
+	time.Sleep(200 * time.Millisecond)
+
+	handler.HandleMeters(map[string]float64{"c": 3})
+	c0.Expect("replay", map[string]float64{"x": 1, "c": 3})
+
+	if err := handler.Flush(ctx); err != nil {
+		t.Fatalf("FAIL: unable to flush: %s", err)
+	}
+
+	if size := handler.hosts[0].spool.Len(); size != 0 {
+		t.Errorf("FAIL: spool was not replayed: %d", size)
+	}
+}
+
+func TestCarbonHandler_SpoolOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meter-carbon-spool")
+	if err != nil {
+		t.Fatalf("FATAL: unable to create spool dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c0 := &TestCarbon{T: t, Name: "overflow"}
+	c0.Init()
+	defer c0.Stop()
+
+	handler := &CarbonHandler{URLs: []string{c0.URL}, SpoolDir: dir, QueueSize: 1}
+	handler.Close()
+
+	select {
+	case <-handler.hosts[0].doneC:
+	default:
+		t.Fatalf("FAIL: host still running after close")
+	}
+
+	// Nothing consumes the queue of the host once closed so the first batch
+	// fills the queue and the following ones overflow into the spool.
+	handler.HandleMeters(map[string]float64{"a": 1})
+
+	if size := handler.hosts[0].spool.Len(); size != 0 {
+		t.Errorf("FAIL: unexpected spooled values: %d", size)
+	}
+
+	handler.HandleMeters(map[string]float64{"b": 2})
+
+	if size := handler.hosts[0].spool.Len(); size == 0 {
+		t.Errorf("FAIL: overflow was not spooled")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	if err := handler.Flush(ctx); err != nil {
+		t.Errorf("FAIL: unable to flush closed handler: %s", err)
+	}
+
+	handler.Close()
+}
+
+func TestCarbonSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meter-carbon-spool")
+	if err != nil {
+		t.Fatalf("FATAL: unable to create spool dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool := newCarbonSpool(dir, "localhost:2003", 1<<20)
+
+	exp := []carbonMetric{{"a.b", 1.5, 100}, {"c", -2, 200}}
+	for i := 0; i < carbonSpoolBatch; i++ {
+		exp = append(exp, carbonMetric{"d", float64(i), 300})
+	}
+
+	if err := spool.Write(exp[:2]); err != nil {
+		t.Fatalf("FAIL: unable to write: %s", err)
+	}
+
+	if err := spool.Write(exp[2:]); err != nil {
+		t.Fatalf("FAIL: unable to write: %s", err)
+	}
+
+	// A new spool picks up the values left behind by a previous process.
+	spool = newCarbonSpool(dir, "localhost:2003", 1<<20)
+
+	var metrics []carbonMetric
+	err = spool.Replay(func(batch []carbonMetric) error {
+		metrics = append(metrics, batch...)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("FAIL: unable to replay: %s", err)
+	}
+
+	if !reflect.DeepEqual(metrics, exp) {
+		t.Errorf("FAIL: replay mismatch %v != %v", metrics[:2], exp[:2])
+	}
+
+	if spool.Len() != 0 {
+		t.Errorf("FAIL: spool not empty after replay: %d", spool.Len())
+	}
+
+	full := newCarbonSpool(dir, "full", 1)
+	full.Write(exp[:1])
+
+	if err := full.Write(exp[:1]); err == nil {
+		t.Errorf("FAIL: expected error when writing to a full spool")
+	}
+}
+
+func TestCarbonHandler_UDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("FATAL: unable to listen: %s", err)
+	}
+	defer conn.Close()
+
+	handler := NewCarbonHandler("udp://" + conn.LocalAddr().String())
+	defer handler.Close()
+
+	handler.HandleSamples([]Sample{
+		{Key: "a", Value: 0.123456789, Timestamp: time.Unix(100, 0)},
+		{Key: "b", Value: 1e21, Timestamp: time.Unix(100, 0)},
+	})
+
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("FATAL: unable to read: %s", err)
+	}
+
+	lines := strings.Split(string(buffer[:n]), "\n")
+	sort.Strings(lines)
+
+	exp := []string{"", "a 0.123456789 100", "b 1e+21 100"}
+	if !reflect.DeepEqual(lines, exp) {
+		t.Errorf("FAIL: lines mismatch %q != %q", lines, exp)
+	}
+}
+
+func TestCarbonRing(t *testing.T) {
+	ring, err := newCarbonRing([]carbonNode{
+		{Server: "10.0.0.1"},
+		{Server: "10.0.0.2"},
+		{Server: "10.0.0.3", Instance: "a"},
+	})
+	if err != nil {
+		t.Fatalf("FATAL: unable to create ring: %s", err)
+	}
+
+	// Generated with the ConsistentHashRing of carbon.
+	exp := map[string][]int{
+		"a.b.c": {1, 0, 2},
+		"k1":    {1, 2, 0},
+		"k2":    {0, 1, 2},
+		"k5":    {0, 2, 1},
+		"k6":    {2, 0, 1},
+	}
+
+	for key, nodes := range exp {
+		if result := ring.Nodes(key, 3); !reflect.DeepEqual(result, nodes) {
+			t.Errorf("FAIL: nodes mismatch for '%s' -> %v != %v", key, result, nodes)
+		}
+
+		if result := ring.Nodes(key, 1); !reflect.DeepEqual(result, nodes[:1]) {
+			t.Errorf("FAIL: first node mismatch for '%s' -> %v != %v", key, result, nodes[:1])
+		}
+	}
+
+	if _, err := newCarbonRing([]carbonNode{{Server: "h"}, {Server: "h"}}); err == nil {
+		t.Errorf("FAIL: expected error on duplicate nodes")
+	}
+}
+
+func TestCarbonRing_Diverse(t *testing.T) {
+	ring, err := newCarbonRing([]carbonNode{
+		{Server: "10.0.0.1", Instance: "a"},
+		{Server: "10.0.0.1", Instance: "b"},
+		{Server: "10.0.0.2", Instance: "a"},
+	})
+	if err != nil {
+		t.Fatalf("FATAL: unable to create ring: %s", err)
+	}
+
+	// Generated with the ConsistentHashingRouter of carbon with a replication
+	// factor of 2 with and without DIVERSE_REPLICAS.
+	exp := map[string][2][]int{
+		"a.b.c": {{2, 1}, {2, 1}},
+		"k1":    {{1, 0}, {1, 2}},
+		"k2":    {{0, 2}, {0, 2}},
+		"k3":    {{0, 1}, {0, 2}},
+		"k7":    {{0, 1}, {0, 2}},
+	}
+
+	for key, nodes := range exp {
+		if result := ring.Nodes(key, 2); !reflect.DeepEqual(result, nodes[0]) {
+			t.Errorf("FAIL: nodes mismatch for '%s' -> %v != %v", key, result, nodes[0])
+		}
+
+		if result := ring.DiverseNodes(key, 2); !reflect.DeepEqual(result, nodes[1]) {
+			t.Errorf("FAIL: diverse nodes mismatch for '%s' -> %v != %v", key, result, nodes[1])
+		}
+	}
+
+	// Only two distinct servers are available for the replicas.
+	if result := ring.DiverseNodes("k1", 3); !reflect.DeepEqual(result, []int{1, 2}) {
+		t.Errorf("FAIL: diverse nodes mismatch for 'k1' -> %v != [1 2]", result)
+	}
+}
+
+func TestCarbonHandler_ConsistentHashing(t *testing.T) {
+	c0 := &TestCarbon{T: t, Name: "ch0"}
+	c1 := &TestCarbon{T: t, Name: "ch1"}
+
+	c0.Init()
+	c1.Init()
+
+	handler := &CarbonHandler{
+		URLs:              []string{"tcp://" + c0.URL + "#a", "tcp://" + c1.URL + "#b"},
+		ConsistentHashing: true,
+	}
+	handler.Init()
+	defer handler.Close()
+
+	values := make(map[string]float64)
+	exp := []map[string]float64{{}, {}}
+
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		values[key] = float64(i)
+
+		node := handler.ring.Nodes(key, 1)[0]
+		exp[node][key] = float64(i)
+	}
+
+	if len(exp[0]) == 0 || len(exp[1]) == 0 {
+		t.Fatalf("FAIL: keys not spread across hosts %v", exp)
+	}
+
+	handler.HandleMeters(values)
+
+	c0.WaitConn("hash")
+	c1.WaitConn("hash")
+
+	c0.Expect("hash", exp[0])
+	c1.Expect("hash", exp[1])
+}
+
+func TestCarbonHandler_Tags(t *testing.T) {
+	handler := &CarbonHandler{
+		Rules: []TagRule{
+			{Pattern: "http.*.*", Name: "http.{1}", Tags: map[string]string{"route": "{0}"}},
+		},
+		Tags: map[string]string{"host": "web-01", "dc": "us east;1", "route": "default"},
+	}
+
+	check := func(sample Sample, exp string) {
+		if path := handler.path(sample); path != exp {
+			t.Errorf("FAIL: path mismatch '%s' != '%s'", path, exp)
+		}
+	}
+
+	check(Sample{Key: "http.login.latency"}, "http.latency;dc=us_east_1;host=web-01;route=login")
+	check(Sample{Key: "a.b"}, "a.b;dc=us_east_1;host=web-01;route=default")
+	check(Sample{Key: "a b;c", Labels: Labels{"status": "~500", "x=y": "z"}},
+		"a_b_c;dc=us_east_1;host=web-01;route=default;status=_500;x_y=z")
+	check(Sample{Key: "a", Labels: Labels{"empty": ""}}, "a;dc=us_east_1;host=web-01;route=default")
+
+	plain := &CarbonHandler{}
+	if path := plain.path(Sample{Key: "a", Labels: Labels{"k": "v"}}); path != "a.v" {
+		t.Errorf("FAIL: path mismatch '%s' != 'a.v'", path)
+	}
+}
+
+func TestEncodePickle(t *testing.T) {
+	msg := encodePickle([]carbonMetric{{"a.b", 1.5, 100}, {"c\u00e9", -2, 1 << 40}})
+
+	// Generated and verified with python's pickle.loads.
+	exp := "0000003b80025d285803000000612e624a64000000473ff800000000000086865803000000" +
+		"63c3a98a08000000000001000047c0000000000000008686652e"
+
+	if hex := fmt.Sprintf("%x", msg); hex != exp {
+		t.Errorf("FAIL: pickle mismatch\n%s\n!=\n%s", hex, exp)
+	}
+}
+
+func TestParseCarbonURL(t *testing.T) {
+	check := func(URL, scheme, addr, instance string, fail bool) {
+		s, a, i, err := parseCarbonURL(URL)
+		if (err != nil) != fail || s != scheme || a != addr || i != instance {
+			t.Errorf("FAIL: parse mismatch for '%s' -> %s %s %s %v", URL, s, a, i, err)
+		}
+	}
+
+	check("localhost:2003", "tcp", "localhost:2003", "", false)
+	check("tcp://localhost:2003", "tcp", "localhost:2003", "", false)
+	check("udp://localhost:2003", "udp", "localhost:2003", "", false)
+	check("pickle://localhost:2004#a", "pickle", "localhost:2004", "a", false)
+	check("http://localhost:2004", "", "", "", true)
 }
 
 func CarbonSend(title string, handler *CarbonHandler, carbons ...*TestCarbon) {
@@ -76,6 +432,7 @@ type TestCarbon struct {
 
 	listenC chan net.Listener
 	connC   chan net.Conn
+	acceptC chan net.Conn
 
 	listen net.Listener
 	conns  []net.Conn
@@ -117,12 +474,24 @@ func (carbon *TestCarbon) Expect(title string, exp map[string]float64) {
 	CheckValues(carbon.T, fmt.Sprintf("%s.%s", title, carbon.Name), values, exp)
 }
 
+// WaitConn waits for the carbon to accept a new connection.
+func (carbon *TestCarbon) WaitConn(title string) {
+	carbon.Init()
+
+	select {
+	case <-carbon.acceptC:
+	case <-time.After(1 * time.Second):
+		carbon.T.Errorf("FAIL(%s.%s): no connection accepted", title, carbon.Name)
+	}
+}
+
 func (carbon *TestCarbon) init() {
 	carbon.pairC = make(chan CarbonPair, 1<<16)
 	carbon.stopC = make(chan int)
 	carbon.startC = make(chan int)
 	carbon.listenC = make(chan net.Listener)
 	carbon.connC = make(chan net.Conn)
+	carbon.acceptC = make(chan net.Conn, 1<<8)
 
 	go carbon.accept()
 
@@ -158,6 +527,11 @@ func (carbon *TestCarbon) accept() {
 
 			carbon.connC <- conn
 			go carbon.handle(conn)
+
+			select {
+			case carbon.acceptC <- conn:
+			default:
+			}
 		}
 
 		<-carbon.startC
@@ -4,16 +4,48 @@ package meter
 
 import (
 	"github.com/datacratic/goklog/klog"
-	"github.com/datacratic/gorest/rest"
 
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"sync"
 	"time"
 )
 
+// DefaultHTTPQueueSize is used if QueueSize is not set in HTTPHandler.
+const DefaultHTTPQueueSize = 64
+
+// DefaultHTTPRetries is used if MaxRetries is not set in HTTPHandler.
+const DefaultHTTPRetries = 5
+
+var (
+	// DefaultHTTPRetryDelay is used if RetryDelay is not set in HTTPHandler.
+	DefaultHTTPRetryDelay = 1 * time.Second
+
+	// DefaultHTTPMaxRetryDelay is used if MaxRetryDelay is not set in
+	// HTTPHandler.
+	DefaultHTTPMaxRetryDelay = 1 * time.Minute
+
+	// DefaultHTTPTimeout is the timeout of the requests made by the default
+	// HTTPClient of HTTPHandler.
+	DefaultHTTPTimeout = 30 * time.Second
+)
+
 // HTTPHandler is used forward the recorded meter values to a remote HTTP
 // endpoint.
+//
+// Values are queued and sent asynchronously by a dedicated go-routine such
+// that a slow or unavailable endpoint doesn't block the poller. If the queue is
+// full then the oldest values are dropped. Requests which fail because of a
+// network error or a 429 or 5xx status are retried with an exponential backoff
+// and the values polled in the meantime are batched into a single request once
+// the endpoint is available.
 type HTTPHandler struct {
 
 	// URL is the remote HTTP endpoint where meter values should be sent
@@ -25,11 +57,67 @@ type HTTPHandler struct {
 	Method string
 
 	// HTTPClient can be used to optionally customize the HTTPClient used to
-	// make the HTTP requests.
+	// make the HTTP requests. Defaults to a client which uses the settings of
+	// http.DefaultTransport and times out after DefaultHTTPTimeout.
 	HTTPClient *http.Client
 
+	// TLSConfig is used to configure the TLS connections of the default
+	// HTTPClient. NewTLSConfig can be used to configure client certificates
+	// and custom certificate authorities. Ignored if HTTPClient is set.
+	TLSConfig *tls.Config
+
+	// BearerToken is sent as a bearer token in the Authorization header of
+	// every request if set.
+	BearerToken string
+
+	// Username and Password are used for HTTP basic authentication if
+	// Username is set.
+	Username string
+	Password string
+
+	// SignRequest is an optional hook which is called with every request and
+	// its body right before the request is sent. It can be used to sign the
+	// request by adding the appropriate headers.
+	SignRequest func(request *http.Request, body []byte) error
+
+	// Encoder is used to encode the values into the body of the requests.
+	// Defaults to JSONEncoder.
+	Encoder Encoder
+
+	// Compress enables the gzip compression of the request bodies. Ignored if
+	// the Encoder already sets a Content-Encoding header.
+	Compress bool
+
+	// QueueSize is the maximum number of polled batches of values waiting to
+	// be sent. Defaults to DefaultHTTPQueueSize.
+	QueueSize int
+
+	// MaxBatchSize is the maximum number of polled batches of values that can
+	// be sent in a single request. How multiple batches are combined in a
+	// single body depends on the Encoder. Defaults to 1. JSONEncoder can only
+	// batch multiple polls if Array is set which is the case for the default
+	// encoder when MaxBatchSize is greater than one.
+	MaxBatchSize int
+
+	// MaxRetries is the maximum number of times a request is retried before
+	// its values are dropped. A negative value disables retries. Defaults to
+	// DefaultHTTPRetries.
+	MaxRetries int
+
+	// RetryDelay is the delay before the first retry which is doubled on
+	// every subsequent retry. Defaults to DefaultHTTPRetryDelay.
+	RetryDelay time.Duration
+
+	// MaxRetryDelay bounds the delay between two retries. Defaults to
+	// DefaultHTTPMaxRetryDelay.
+	MaxRetryDelay time.Duration
+
 	initialize sync.Once
-	client     *rest.Client
+
+	queueC chan []Sample
+	flushC chan chan struct{}
+
+	clock clockRef
 }
 
 // Init initializes the object. Note that calling this is optional in which case
@@ -52,30 +140,236 @@ func (handler *HTTPHandler) init() {
 	}
 
 	if handler.HTTPClient == nil {
-		handler.HTTPClient = http.DefaultClient
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = handler.TLSConfig
+
+		handler.HTTPClient = &http.Client{Transport: transport, Timeout: DefaultHTTPTimeout}
 	}
 
-	handler.client = &rest.Client{
-		Client: handler.HTTPClient,
-		Root:   handler.URL,
+	if handler.QueueSize == 0 {
+		handler.QueueSize = DefaultHTTPQueueSize
 	}
+
+	if handler.MaxBatchSize == 0 {
+		handler.MaxBatchSize = 1
+	}
+
+	if handler.Encoder == nil {
+		handler.Encoder = JSONEncoder{Array: handler.MaxBatchSize > 1, Clock: &handler.clock}
+	}
+
+	if encoder, ok := handler.Encoder.(JSONEncoder); ok && !encoder.Array && handler.MaxBatchSize > 1 {
+		klog.KFatal("meter.http.init.error", "JSONEncoder requires Array when MaxBatchSize is greater than one")
+	}
+
+	if encoder, ok := handler.Encoder.(OTLPEncoder); ok && encoder.StartTime.IsZero() {
+		encoder.StartTime = handler.clock.Get().Now()
+		handler.Encoder = encoder
+	}
+
+	if handler.MaxRetries == 0 {
+		handler.MaxRetries = DefaultHTTPRetries
+	}
+
+	if handler.RetryDelay == 0 {
+		handler.RetryDelay = DefaultHTTPRetryDelay
+	}
+
+	if handler.MaxRetryDelay == 0 {
+		handler.MaxRetryDelay = DefaultHTTPMaxRetryDelay
+	}
+
+	handler.queueC = make(chan []Sample, handler.QueueSize)
+	handler.flushC = make(chan chan struct{})
+
+	go handler.run()
+}
+
+// SetClock sets the clock used to wait between retries and to timestamp the
+// values passed to HandleMeters.
+func (handler *HTTPHandler) SetClock(clock Clock) {
+	handler.clock.Set(clock)
 }
 
-// HandleMeters sends the given values to the configured remote HTTP endpoint.
+// HandleMeters queues the given values to be sent to the configured remote
+// HTTP endpoint.
 func (handler *HTTPHandler) HandleMeters(values map[string]float64) {
+	handler.HandleSamples(newSamples(values, &handler.clock))
+}
+
+// HandleSamples queues the given samples to be sent to the configured remote
+// HTTP endpoint where the timestamp is the time at which the samples were
+// polled. The oldest queued samples are dropped if the queue is full.
+func (handler *HTTPHandler) HandleSamples(samples []Sample) {
+	handler.Init()
+
+	for {
+		select {
+		case handler.queueC <- samples:
+			return
+		default:
+		}
+
+		select {
+		case dropped := <-handler.queueC:
+			klog.KPrintf("meter.http.queue.error", "queue full: dropping %d values", len(dropped))
+		default:
+		}
+	}
+}
+
+// Flush blocks until all the queued values were either sent or dropped or
+// until the context is done.
+func (handler *HTTPHandler) Flush(ctx context.Context) error {
 	handler.Init()
 
-	var body struct {
-		Timestamp int64              `json:"timestamp"`
-		Values    map[string]float64 `json:"values"`
+	doneC := make(chan struct{})
+
+	select {
+	case handler.flushC <- doneC:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-doneC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
+
+func (handler *HTTPHandler) run() {
+	for {
+		select {
+		case samples := <-handler.queueC:
+			handler.send(handler.batch(samples))
 
-	body.Timestamp = time.Now().Unix()
-	body.Values = values
+		case doneC := <-handler.flushC:
+			for drained := false; !drained; {
+				select {
+				case samples := <-handler.queueC:
+					handler.send(handler.batch(samples))
+				default:
+					drained = true
+				}
+			}
+			close(doneC)
+		}
+	}
+}
 
-	resp := handler.client.NewRequest(handler.Method).SetBody(body).Send()
+// batch gathers up to MaxBatchSize queued batches of samples.
+func (handler *HTTPHandler) batch(samples []Sample) [][]Sample {
+	batch := [][]Sample{samples}
 
-	if err := resp.GetBody(nil); err != nil {
-		klog.KPrintf("meter.http.send.error", "unable to send metrics: %s", err)
+	for len(batch) < handler.MaxBatchSize {
+		select {
+		case samples := <-handler.queueC:
+			batch = append(batch, samples)
+		default:
+			return batch
+		}
 	}
+
+	return batch
+}
+
+func (handler *HTTPHandler) send(batch [][]Sample) {
+	header := make(http.Header)
+
+	body, err := handler.Encoder.Encode(batch, header)
+	if err != nil {
+		klog.KPrintf("meter.http.encode.error", "unable to encode metrics: %s", err)
+		return
+	}
+
+	delay := handler.RetryDelay
+
+	for attempt := 0; ; attempt++ {
+		retry, err := handler.post(body, header)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt >= handler.MaxRetries {
+			klog.KPrintf("meter.http.send.error", "unable to send metrics: %s", err)
+			return
+		}
+
+		klog.KPrintf("meter.http.retry.error", "unable to send metrics, retrying in %s: %s", delay, err)
+		<-handler.clock.Get().After(delay)
+
+		if delay *= 2; delay > handler.MaxRetryDelay {
+			delay = handler.MaxRetryDelay
+		}
+	}
+}
+
+// post sends the given body with the given headers and indicates whether the
+// request should be retried if it failed.
+func (handler *HTTPHandler) post(body []byte, header http.Header) (retry bool, err error) {
+	request, err := http.NewRequest(handler.Method, handler.URL, nil)
+	if err != nil {
+		return
+	}
+
+	for key, values := range header {
+		request.Header[key] = values
+	}
+
+	if handler.Compress && request.Header.Get("Content-Encoding") == "" {
+		buffer := new(bytes.Buffer)
+		writer := gzip.NewWriter(buffer)
+		writer.Write(body)
+
+		if err = writer.Close(); err != nil {
+			return
+		}
+
+		body = buffer.Bytes()
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	request.ContentLength = int64(len(body))
+	request.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	if err = handler.authorize(request, body); err != nil {
+		return
+	}
+
+	response, err := handler.HTTPClient.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		retry = response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+		err = fmt.Errorf("unexpected status '%s': %s", response.Status, bytes.TrimSpace(msg))
+	}
+
+	return
+}
+
+// authorize adds the authentication headers to the given request and calls the
+// SignRequest hook.
+func (handler *HTTPHandler) authorize(request *http.Request, body []byte) error {
+	if handler.BearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+handler.BearerToken)
+
+	} else if handler.Username != "" {
+		request.SetBasicAuth(handler.Username, handler.Password)
+	}
+
+	if handler.SignRequest != nil {
+		return handler.SignRequest(request, body)
+	}
+
+	return nil
 }
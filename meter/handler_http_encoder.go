@@ -0,0 +1,197 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// Encoder encodes the values sent by an HTTPHandler into the body of an HTTP
+// request. Each batch in the batches passed to Encode contains the samples of
+// a single poll.
+type Encoder interface {
+
+	// Encode returns the body of the request for the given batches of
+	// samples and sets the headers that describe the body (eg. Content-Type
+	// or Content-Encoding) in the given header.
+	Encode(batches [][]Sample, header http.Header) ([]byte, error)
+}
+
+// JSONEncoder encodes each batch of samples as a JSON object of the form
+// {"timestamp": 1400000000, "values": {"key": 1.0}} where labels are flattened
+// into the keys. A single batch is encoded per body unless Array is set in
+// which case the batches are always encoded as a JSON array of objects, even
+// if there's only one. This is the default encoder of HTTPHandler where Array
+// is set if MaxBatchSize is greater than one.
+type JSONEncoder struct {
+
+	// Array encodes the batches as a JSON array of objects which allows
+	// multiple batches to be sent in a single body.
+	Array bool
+
+	// Clock is used to timestamp the batches without any samples. Defaults
+	// to SystemClock. The default encoder of HTTPHandler uses the clock of
+	// the handler.
+	Clock Clock
+}
+
+type jsonBatch struct {
+	Timestamp int64              `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+// Encode encodes the given batches of samples. An error is returned if
+// multiple batches are given and Array is not set.
+func (encoder JSONEncoder) Encode(batches [][]Sample, header http.Header) ([]byte, error) {
+	if !encoder.Array && len(batches) != 1 {
+		return nil, fmt.Errorf("unable to encode %d batches without Array", len(batches))
+	}
+
+	header.Set("Content-Type", "application/json")
+
+	clock := encoder.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	var bodies []jsonBatch
+
+	for _, samples := range batches {
+		body := jsonBatch{Values: FlattenSamples(samples)}
+
+		if len(samples) > 0 {
+			body.Timestamp = samples[0].Timestamp.Unix()
+		} else {
+			body.Timestamp = clock.Now().Unix()
+		}
+		bodies = append(bodies, body)
+	}
+
+	if !encoder.Array {
+		return json.Marshal(bodies[0])
+	}
+	return json.Marshal(bodies)
+}
+
+// JSONLinesEncoder encodes every sample as a JSON object on its own line of the
+// form {"key": "a.b", "labels": {"k": "v"}, "value": 1.0, "kind": "counter",
+// "unit": "seconds", "timestamp": 1400000000} where the labels, the unit and
+// the help are omitted if empty.
+type JSONLinesEncoder struct{}
+
+type jsonLine struct {
+	Key       string  `json:"key"`
+	Labels    Labels  `json:"labels,omitempty"`
+	Value     float64 `json:"value"`
+	Kind      string  `json:"kind"`
+	Unit      string  `json:"unit,omitempty"`
+	Help      string  `json:"help,omitempty"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// Encode encodes the given batches of samples.
+func (JSONLinesEncoder) Encode(batches [][]Sample, header http.Header) ([]byte, error) {
+	header.Set("Content-Type", "application/x-ndjson")
+
+	buffer := new(bytes.Buffer)
+	encoder := json.NewEncoder(buffer)
+
+	for _, samples := range batches {
+		for _, sample := range samples {
+			err := encoder.Encode(jsonLine{
+				Key:       sample.Key,
+				Labels:    sample.Labels,
+				Value:     sample.Value,
+				Kind:      sample.Kind.String(),
+				Unit:      sample.Unit,
+				Help:      sample.Help,
+				Timestamp: sample.Timestamp.Unix(),
+			})
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// InfluxEncoder encodes the samples using the Influx line protocol. See
+// InfluxHandler for more details on the format.
+type InfluxEncoder struct {
+
+	// Rules are applied in order to the keys and the first matching rule
+	// determines the measurement name and the tags of the key.
+	Rules []TagRule
+
+	// Tags are added to every line.
+	Tags map[string]string
+}
+
+// Encode encodes the given batches of samples.
+func (encoder InfluxEncoder) Encode(batches [][]Sample, header http.Header) ([]byte, error) {
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	var lines []string
+	for _, samples := range batches {
+		lines = append(lines, formatInflux(samples, encoder.Rules, encoder.Tags)...)
+	}
+
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+// TemplateData is passed to the template of a TemplateEncoder.
+type TemplateData struct {
+
+	// Batches contains the samples of each poll.
+	Batches [][]Sample
+
+	// Samples contains the samples of all the polls.
+	Samples []Sample
+}
+
+// TemplateEncoder encodes the samples using a user provided template. As an
+// example, the following template outputs one line per sample:
+//
+//	{{range .Samples}}{{.FlatKey}} {{.Value}} {{.Timestamp.Unix}}
+//	{{end}}
+type TemplateEncoder struct {
+
+	// Template is executed with a TemplateData object. This field must be
+	// set.
+	Template *template.Template
+
+	// ContentType is the content type of the body. Defaults to text/plain.
+	ContentType string
+}
+
+// Encode encodes the given batches of samples.
+func (encoder TemplateEncoder) Encode(batches [][]Sample, header http.Header) ([]byte, error) {
+	contentType := encoder.ContentType
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	header.Set("Content-Type", contentType)
+
+	data := TemplateData{Batches: batches}
+	for _, samples := range batches {
+		data.Samples = append(data.Samples, samples...)
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := encoder.Template.Execute(buffer, data); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
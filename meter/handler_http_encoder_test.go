@@ -0,0 +1,343 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func EncoderSamples() [][]Sample {
+	ts := time.Unix(1000, 0)
+
+	return [][]Sample{
+		{
+			{Key: "a.b", Labels: Labels{"x": "1"}, Value: 1, Kind: KindCounter, Unit: "seconds", Timestamp: ts},
+		},
+		{
+			{Key: "c", Value: 2.5, Kind: KindGauge, Timestamp: ts.Add(time.Second)},
+		},
+	}
+}
+
+func CheckEncoder(t *testing.T, title string, encoder Encoder, expType, exp string) {
+	header := make(http.Header)
+
+	body, err := encoder.Encode(EncoderSamples(), header)
+	if err != nil {
+		t.Errorf("FAIL(%s): unexpected error: %s", title, err)
+		return
+	}
+
+	if contentType := header.Get("Content-Type"); contentType != expType {
+		t.Errorf("FAIL(%s): content type mismatch '%s' != '%s'", title, contentType, expType)
+	}
+
+	if string(body) != exp {
+		t.Errorf("FAIL(%s): body mismatch\n%q\n!=\n%q", title, body, exp)
+	}
+}
+
+func TestEncoders(t *testing.T) {
+	CheckEncoder(t, "json", JSONEncoder{Array: true}, "application/json",
+		`[{"timestamp":1000,"values":{"a.b.1":1}},{"timestamp":1001,"values":{"c":2.5}}]`)
+
+	CheckEncoder(t, "jsonl", JSONLinesEncoder{}, "application/x-ndjson",
+		`{"key":"a.b","labels":{"x":"1"},"value":1,"kind":"counter","unit":"seconds","timestamp":1000}`+"\n"+
+			`{"key":"c","value":2.5,"kind":"gauge","timestamp":1001}`+"\n")
+
+	CheckEncoder(t, "influx", InfluxEncoder{Tags: map[string]string{"host": "h"}}, "text/plain; charset=utf-8",
+		"a.b,host=h,x=1 value=1 1000000000000\n"+
+			"c,host=h value=2.5 1001000000000\n")
+
+	tmpl := template.Must(template.New("").Parse(
+		"{{len .Batches}}\n{{range .Samples}}{{.FlatKey}} {{.Value}} {{.Timestamp.Unix}}\n{{end}}"))
+
+	CheckEncoder(t, "template", TemplateEncoder{Template: tmpl}, "text/plain",
+		"2\na.b.1 1 1000\nc 2.5 1001\n")
+}
+
+func TestJSONEncoder(t *testing.T) {
+	batches := EncoderSamples()
+
+	check := func(title string, encoder JSONEncoder, batches [][]Sample, exp string) {
+		body, err := encoder.Encode(batches, make(http.Header))
+		if err != nil {
+			t.Errorf("FAIL(%s): unexpected error: %s", title, err)
+		} else if string(body) != exp {
+			t.Errorf("FAIL(%s): body mismatch '%s' != '%s'", title, body, exp)
+		}
+	}
+
+	// The shape of the body only depends on Array and not on the number of
+	// batches.
+	check("object", JSONEncoder{}, batches[:1], `{"timestamp":1000,"values":{"a.b.1":1}}`)
+	check("array-1", JSONEncoder{Array: true}, batches[:1], `[{"timestamp":1000,"values":{"a.b.1":1}}]`)
+	check("array-n", JSONEncoder{Array: true}, batches,
+		`[{"timestamp":1000,"values":{"a.b.1":1}},{"timestamp":1001,"values":{"c":2.5}}]`)
+
+	if _, err := (JSONEncoder{}).Encode(batches, make(http.Header)); err == nil {
+		t.Errorf("FAIL: expected error when encoding multiple batches without Array")
+	}
+}
+
+func TestRemoteWriteEncoder(t *testing.T) {
+	header := make(http.Header)
+
+	body, err := RemoteWriteEncoder{}.Encode(EncoderSamples(), header)
+	if err != nil {
+		t.Fatalf("FAIL: unexpected error: %s", err)
+	}
+
+	if encoding := header.Get("Content-Encoding"); encoding != "snappy" {
+		t.Errorf("FAIL: content encoding mismatch '%s'", encoding)
+	}
+
+	series1 := "" +
+		"\x0a\x0f" + "\x0a\x08__name__\x12\x03a_b" +
+		"\x0a\x06" + "\x0a\x01x\x12\x011" +
+		"\x12\x0d" + "\x09\x00\x00\x00\x00\x00\x00\xf0\x3f" + "\x10\xc0\x84\x3d"
+
+	series2 := "" +
+		"\x0a\x0d" + "\x0a\x08__name__\x12\x01c" +
+		"\x12\x0d" + "\x09\x00\x00\x00\x00\x00\x00\x04\x40" + "\x10\xa8\x8c\x3d"
+
+	exp := "\x0a\x28" + series1 + "\x0a\x1e" + series2
+
+	request, err := SnappyDecode(body)
+	if err != nil {
+		t.Fatalf("FAIL: unable to decode body: %s", err)
+	}
+
+	if string(request) != exp {
+		t.Errorf("FAIL: request mismatch\n%q\n!=\n%q", request, exp)
+	}
+}
+
+func TestRemoteWriteEncoder_Summary(t *testing.T) {
+	samples := []Sample{
+		{Key: "lat.p99", Value: 3, Kind: KindPercentile},
+		{Key: "lat.count", Value: 2, Kind: KindHistogram},
+		{Key: "lat.avg", Value: 1.5, Kind: KindHistogram},
+	}
+
+	body, err := RemoteWriteEncoder{}.Encode([][]Sample{samples}, make(http.Header))
+	if err != nil {
+		t.Fatalf("FAIL: unexpected error: %s", err)
+	}
+
+	if body, err = SnappyDecode(body); err != nil {
+		t.Fatalf("FAIL: unable to decode body: %s", err)
+	}
+
+	for _, exp := range []string{"\x12\x03lat", "\x12\x09lat_count", "\x12\x07lat_sum", "\x0a\x08quantile\x12\x040.99"} {
+		if !bytes.Contains(body, []byte(exp)) {
+			t.Errorf("FAIL: missing %q in %q", exp, body)
+		}
+	}
+
+	if bytes.Contains(body, []byte("lat_p99")) || bytes.Contains(body, []byte("lat_avg")) {
+		t.Errorf("FAIL: percentiles not grouped into a summary %q", body)
+	}
+}
+
+func TestSnappyEncode(t *testing.T) {
+	random := rand.New(rand.NewSource(0))
+
+	check := func(title string, data []byte) []byte {
+		body := snappyEncode(data)
+
+		decoded, err := SnappyDecode(body)
+		if err != nil {
+			t.Errorf("FAIL(%s): unable to decode: %s", title, err)
+		} else if !bytes.Equal(decoded, data) {
+			t.Errorf("FAIL(%s): snappy mismatch %d != %d", title, len(decoded), len(data))
+		}
+
+		return body
+	}
+
+	for _, n := range []int{0, 1, 60, 61, 256, 257, 1 << 16, 1<<16 + 1, 1 << 18} {
+		data := make([]byte, n)
+		random.Read(data)
+		check(fmt.Sprintf("random-%d", n), data)
+
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+
+		if body := check(fmt.Sprintf("cycle-%d", n), data); n > 1024 && len(body) > n/10 {
+			t.Errorf("FAIL(cycle-%d): not compressed %d", n, len(body))
+		}
+	}
+
+	// Long matches, overlapping copies and short matches with both offset
+	// sizes.
+	check("zeros", make([]byte, 1000))
+	check("short", []byte("abcdabcdXabcdYYYYYYYYYYYYabcd"))
+	check("far", append(append([]byte("0123456789abcdef"), make([]byte, 4000)...), "0123456789abcdef"...))
+
+	data := bytes.Repeat([]byte("http_requests_total{method=\"GET\",status=\"200\"} "), 100)
+	if body := check("metrics", data); len(body) >= len(data)/4 {
+		t.Errorf("FAIL: repetitive input not compressed %d >= %d", len(body), len(data)/4)
+	}
+}
+
+// SnappyDecode decodes a snappy block as described by the format description
+// of the snappy project.
+func SnappyDecode(body []byte) ([]byte, error) {
+	length, n := binary.Uvarint(body)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid length")
+	}
+	body = body[n:]
+
+	var decoded []byte
+
+	for len(body) > 0 {
+		tag := body[0]
+
+		var offset, size int
+
+		switch tag & 3 {
+
+		case 0:
+			size, body = int(tag>>2), body[1:]
+
+			if size >= 60 {
+				n := size - 59
+				if len(body) < n {
+					return nil, fmt.Errorf("truncated literal length")
+				}
+
+				size = 0
+				for i := 0; i < n; i++ {
+					size |= int(body[i]) << (8 * uint(i))
+				}
+				body = body[n:]
+			}
+
+			if size++; len(body) < size {
+				return nil, fmt.Errorf("truncated literal")
+			}
+
+			decoded, body = append(decoded, body[:size]...), body[size:]
+			continue
+
+		case 1:
+			if len(body) < 2 {
+				return nil, fmt.Errorf("truncated copy")
+			}
+			size, offset = int(tag>>2&7)+4, int(tag>>5)<<8|int(body[1])
+			body = body[2:]
+
+		case 2:
+			if len(body) < 3 {
+				return nil, fmt.Errorf("truncated copy")
+			}
+			size, offset = int(tag>>2)+1, int(binary.LittleEndian.Uint16(body[1:]))
+			body = body[3:]
+
+		case 3:
+			if len(body) < 5 {
+				return nil, fmt.Errorf("truncated copy")
+			}
+			size, offset = int(tag>>2)+1, int(binary.LittleEndian.Uint32(body[1:]))
+			body = body[5:]
+		}
+
+		if offset <= 0 || offset > len(decoded) {
+			return nil, fmt.Errorf("invalid copy offset %d", offset)
+		}
+
+		// Copies can overlap with the bytes being copied.
+		for i := 0; i < size; i++ {
+			decoded = append(decoded, decoded[len(decoded)-offset])
+		}
+	}
+
+	if uint64(len(decoded)) != length {
+		return nil, fmt.Errorf("length mismatch %d != %d", len(decoded), length)
+	}
+
+	return decoded, nil
+}
+
+func TestHTTPHandler_Encoder(t *testing.T) {
+	type result struct {
+		encoding string
+		body     []byte
+	}
+	resultC := make(chan result, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		r := result{encoding: request.Header.Get("Content-Encoding")}
+		r.body, _ = ioutil.ReadAll(request.Body)
+		resultC <- r
+	}))
+	defer server.Close()
+
+	remote := &HTTPHandler{URL: server.URL, Method: "POST", Compress: true, Encoder: RemoteWriteEncoder{}}
+	remote.HandleMeters(map[string]float64{"a": 1})
+
+	if r := <-resultC; r.encoding != "snappy" || len(r.body) == 0 || r.body[0] == 0x1f {
+		t.Errorf("FAIL: unexpected remote-write request encoding='%s' body=%q", r.encoding, r.body)
+	}
+
+	lines := &HTTPHandler{URL: server.URL, Method: "POST", Compress: true, Encoder: JSONLinesEncoder{}}
+	lines.HandleMeters(map[string]float64{"a": 1})
+
+	r := <-resultC
+	if r.encoding != "gzip" {
+		t.Fatalf("FAIL: expected gzip encoding '%s'", r.encoding)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(r.body))
+	if err != nil {
+		t.Fatalf("FAIL: invalid gzip body: %s", err)
+	}
+
+	if body, _ := ioutil.ReadAll(reader); len(body) == 0 || body[len(body)-1] != '\n' {
+		t.Errorf("FAIL: unexpected json lines body %q", body)
+	}
+}
+
+type TestClock struct{ Time time.Time }
+
+func (clock TestClock) Now() time.Time { return clock.Time }
+
+func (clock TestClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func TestHTTPHandler_Clock(t *testing.T) {
+	clock := TestClock{Time: time.Unix(2000, 0)}
+
+	body, err := JSONEncoder{Clock: clock}.Encode([][]Sample{nil}, make(http.Header))
+	if exp := `{"timestamp":2000,"values":{}}`; err != nil || string(body) != exp {
+		t.Errorf("FAIL: empty batch mismatch '%s' != '%s' (%v)", body, exp, err)
+	}
+
+	bodyC := make(chan []byte, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		bodyC <- body
+	}))
+	defer server.Close()
+
+	handler := &HTTPHandler{URL: server.URL, Method: "POST"}
+	handler.SetClock(clock)
+	handler.HandleMeters(map[string]float64{"a": 1})
+
+	if body, exp := string(<-bodyC), `{"timestamp":2000,"values":{"a":1}}`; body != exp {
+		t.Errorf("FAIL: body mismatch '%s' != '%s'", body, exp)
+	}
+}
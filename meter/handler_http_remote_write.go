@@ -0,0 +1,122 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// RemoteWriteEncoder encodes the samples as a Prometheus remote-write request
+// which is a snappy compressed WriteRequest protobuf message.
+//
+// Keys are converted into metric names and histogram percentiles are mapped to
+// a quantile label in the same way as PrometheusHandler while labels are sent as
+// Prometheus labels. Every sample of a series across all the batches is sent in
+// the same time series.
+type RemoteWriteEncoder struct{}
+
+type remoteWriteSeries struct {
+	labels  [][2]string
+	samples []Sample
+}
+
+// Encode encodes the given batches of samples.
+func (RemoteWriteEncoder) Encode(batches [][]Sample, header http.Header) ([]byte, error) {
+	header.Set("Content-Type", "application/x-protobuf")
+	header.Set("Content-Encoding", "snappy")
+	header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	index := make(map[string]*remoteWriteSeries)
+	var keys []string
+
+	for _, samples := range batches {
+		convertPrometheus(samples, func(_, _ string, source Sample, sample promSample) {
+			key := sample.name + promLabels(sample.labels, sample.quantile)
+
+			series, ok := index[key]
+			if !ok {
+				series = &remoteWriteSeries{labels: remoteWriteLabels(sample)}
+				index[key] = series
+				keys = append(keys, key)
+			}
+
+			series.samples = append(series.samples, Sample{Value: sample.value, Timestamp: source.Timestamp})
+		})
+	}
+
+	sort.Strings(keys)
+
+	var request []byte
+	for _, key := range keys {
+		request = protoAppendBytes(request, 1, encodeTimeSeries(index[key]))
+	}
+
+	return snappyEncode(request), nil
+}
+
+// remoteWriteLabels returns the labels of the sample, including the metric
+// name and quantile, sorted by label name as required by the remote-write
+// protocol.
+func remoteWriteLabels(sample promSample) [][2]string {
+	labels := [][2]string{{"__name__", sample.name}}
+
+	for name, value := range sample.labels {
+		labels = append(labels, [2]string{promLabelName(name), value})
+	}
+
+	if sample.quantile != "" {
+		labels = append(labels, [2]string{"quantile", sample.quantile})
+	}
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+	return labels
+}
+
+// encodeTimeSeries encodes the following protobuf messages:
+//
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//
+// where the timestamp is expressed in milliseconds.
+func encodeTimeSeries(series *remoteWriteSeries) []byte {
+	var msg []byte
+
+	for _, label := range series.labels {
+		var buf []byte
+		buf = protoAppendBytes(buf, 1, []byte(label[0]))
+		buf = protoAppendBytes(buf, 2, []byte(label[1]))
+		msg = protoAppendBytes(msg, 1, buf)
+	}
+
+	for _, sample := range series.samples {
+		var buf []byte
+
+		buf = protoAppendVarint(buf, 1<<3|1)
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(sample.Value))
+
+		buf = protoAppendVarint(buf, 2<<3|0)
+		buf = protoAppendVarint(buf, uint64(sample.Timestamp.UnixNano()/1e6))
+
+		msg = protoAppendBytes(msg, 2, buf)
+	}
+
+	return msg
+}
+
+func protoAppendVarint(buf []byte, value uint64) []byte {
+	for value >= 0x80 {
+		buf = append(buf, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(buf, byte(value))
+}
+
+func protoAppendBytes(buf []byte, field int, value []byte) []byte {
+	buf = protoAppendVarint(buf, uint64(field)<<3|2)
+	buf = protoAppendVarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
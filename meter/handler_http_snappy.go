@@ -0,0 +1,107 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"encoding/binary"
+)
+
+// snappyBlockSize is the maximum size of the blocks which are compressed
+// independently such that the offsets of the copies fit in two bytes.
+const snappyBlockSize = 1 << 16
+
+// snappyTableBits is the number of bits of the hash table used to find the
+// previous occurrences of 4 bytes sequences.
+const snappyTableBits = 14
+
+// snappyEncode compresses the given data using the snappy block format where
+// repeated sequences of at least 4 bytes are replaced by copies of their
+// previous occurrence within the same 64KB block.
+func snappyEncode(data []byte) []byte {
+	buf := protoAppendVarint(nil, uint64(len(data)))
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > snappyBlockSize {
+			n = snappyBlockSize
+		}
+
+		buf = snappyEncodeBlock(buf, data[:n])
+		data = data[n:]
+	}
+
+	return buf
+}
+
+func snappyEncodeBlock(buf, block []byte) []byte {
+
+	// Positions are offset by one such that zero marks an empty slot.
+	var table [1 << snappyTableBits]int32
+
+	emit := 0
+
+	for i := 0; i+4 <= len(block); {
+		key := binary.LittleEndian.Uint32(block[i:])
+		hash := (key * 0x1e35a7bd) >> (32 - snappyTableBits)
+
+		candidate := int(table[hash]) - 1
+		table[hash] = int32(i + 1)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(block[candidate:]) != key {
+			i++
+			continue
+		}
+
+		length := 4
+		for i+length < len(block) && block[candidate+length] == block[i+length] {
+			length++
+		}
+
+		buf = snappyAppendLiteral(buf, block[emit:i])
+		buf = snappyAppendCopy(buf, i-candidate, length)
+
+		i += length
+		emit = i
+	}
+
+	return snappyAppendLiteral(buf, block[emit:])
+}
+
+func snappyAppendLiteral(buf, literal []byte) []byte {
+	if len(literal) == 0 {
+		return buf
+	}
+
+	switch n := len(literal) - 1; {
+	case n < 60:
+		buf = append(buf, byte(n)<<2)
+	case n < 1<<8:
+		buf = append(buf, 60<<2, byte(n))
+	default:
+		buf = append(buf, 61<<2, byte(n), byte(n>>8))
+	}
+
+	return append(buf, literal...)
+}
+
+// snappyAppendCopy appends copies of at most 64 bytes with a two bytes offset
+// except for the last copy which uses a one byte offset when possible.
+func snappyAppendCopy(buf []byte, offset, length int) []byte {
+	for length > 64 {
+
+		// Leave at least 4 bytes for the last copy.
+		n := 64
+		if length-n < 4 {
+			n = length - 4
+		}
+
+		buf = append(buf, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+
+	if length < 12 && offset < 1<<11 {
+		return append(buf, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+	}
+
+	return append(buf, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandler_Auth(t *testing.T) {
+	type result struct {
+		user, pass, auth, signature string
+		body                        []byte
+	}
+	resultC := make(chan result, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var r result
+		r.user, r.pass, _ = request.BasicAuth()
+		r.auth = request.Header.Get("Authorization")
+		r.signature = request.Header.Get("X-Signature")
+		r.body, _ = ioutil.ReadAll(request.Body)
+		resultC <- r
+	}))
+	defer server.Close()
+
+	sign := func(body []byte) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	basic := &HTTPHandler{
+		URL:      server.URL,
+		Method:   "POST",
+		Username: "user",
+		Password: "pass",
+		SignRequest: func(request *http.Request, body []byte) error {
+			request.Header.Set("X-Signature", sign(body))
+			return nil
+		},
+	}
+	basic.HandleMeters(map[string]float64{"a": 1})
+
+	r := <-resultC
+	if r.user != "user" || r.pass != "pass" {
+		t.Errorf("FAIL: basic auth mismatch '%s' '%s'", r.user, r.pass)
+	}
+
+	if len(r.body) == 0 || r.signature != sign(r.body) {
+		t.Errorf("FAIL: signature mismatch '%s' for '%s'", r.signature, r.body)
+	}
+
+	bearer := &HTTPHandler{URL: server.URL, Method: "POST", BearerToken: "token"}
+	bearer.HandleMeters(map[string]float64{"a": 1})
+
+	if r := <-resultC; r.auth != "Bearer token" {
+		t.Errorf("FAIL: bearer auth mismatch '%s'", r.auth)
+	}
+}
+
+func TestHTTPHandler_Retry(t *testing.T) {
+	var attempts int32
+	bodyC := make(chan map[string]interface{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			http.Error(writer, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		if encoding := request.Header.Get("Content-Encoding"); encoding != "gzip" {
+			t.Errorf("FAIL: unexpected encoding '%s'", encoding)
+		}
+
+		reader, err := gzip.NewReader(request.Body)
+		if err != nil {
+			t.Errorf("FAIL: invalid gzip body: %s", err)
+			return
+		}
+
+		var body map[string]interface{}
+		if err := json.NewDecoder(reader).Decode(&body); err != nil {
+			t.Errorf("FAIL: invalid body: %s", err)
+		}
+		bodyC <- body
+	}))
+	defer server.Close()
+
+	handler := &HTTPHandler{
+		URL:        server.URL,
+		Method:     "POST",
+		Compress:   true,
+		RetryDelay: 10 * time.Millisecond,
+	}
+	handler.HandleSamples([]Sample{{Key: "a", Value: 1, Timestamp: time.Unix(100, 0)}})
+
+	select {
+	case body := <-bodyC:
+		if body["timestamp"] != float64(100) || body["values"].(map[string]interface{})["a"] != float64(1) {
+			t.Errorf("FAIL: unexpected body %v", body)
+		}
+
+	case <-time.After(1 * time.Second):
+		t.Fatalf("FAIL: timeout waiting for retries (attempts=%d)", atomic.LoadInt32(&attempts))
+	}
+
+	var rejects int32
+
+	rejectServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&rejects, 1)
+		http.Error(writer, "bad request", http.StatusBadRequest)
+	}))
+	defer rejectServer.Close()
+
+	rejected := &HTTPHandler{URL: rejectServer.URL, Method: "POST", RetryDelay: 10 * time.Millisecond}
+	rejected.HandleMeters(map[string]float64{"a": 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	if err := rejected.Flush(ctx); err != nil {
+		t.Fatalf("FAIL: unable to flush: %s", err)
+	}
+
+	if n := atomic.LoadInt32(&rejects); n != 1 {
+		t.Errorf("FAIL: client errors should not be retried: %d", n)
+	}
+}
+
+func TestHTTPHandler_Batch(t *testing.T) {
+	releaseC := make(chan struct{})
+	bodyC := make(chan []byte, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		<-releaseC
+		body, _ := ioutil.ReadAll(request.Body)
+		bodyC <- body
+	}))
+	defer server.Close()
+
+	handler := &HTTPHandler{URL: server.URL, Method: "POST", MaxBatchSize: 10}
+
+	handler.HandleSamples([]Sample{{Key: "a", Value: 0, Timestamp: time.Unix(100, 0)}})
+	time.Sleep(50 * time.Millisecond)
+
+	// The endpoint is now stuck on the first request so the next polls will be
+	// batched together.
+	for i := 1; i <= 3; i++ {
+		handler.HandleSamples([]Sample{{Key: "a", Value: float64(i), Timestamp: time.Unix(100+int64(i), 0)}})
+	}
+
+	close(releaseC)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	if err := handler.Flush(ctx); err != nil {
+		t.Fatalf("FAIL: unable to flush: %s", err)
+	}
+
+	// Batches are always sent as an array when batching is enabled regardless
+	// of the number of batches available.
+	if body := string(<-bodyC); body != `[{"timestamp":100,"values":{"a":0}}]` {
+		t.Errorf("FAIL: first body mismatch '%s'", body)
+	}
+
+	exp := `[{"timestamp":101,"values":{"a":1}},{"timestamp":102,"values":{"a":2}},{"timestamp":103,"values":{"a":3}}]`
+	if body := string(<-bodyC); body != exp {
+		t.Errorf("FAIL: batch body mismatch '%s'", body)
+	}
+}
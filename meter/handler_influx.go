@@ -0,0 +1,289 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"github.com/datacratic/goklog/klog"
+
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultInfluxPacketSize is used if MaxPacketSize is not set in InfluxHandler.
+const DefaultInfluxPacketSize = 1432
+
+// InfluxFieldTag is a special tag which can be produced by the Rules of an
+// InfluxHandler to select the field name of a value instead of the default
+// "value" field. Values sharing the same measurement, tags and timestamp are
+// written on the same line.
+const InfluxFieldTag = "_field"
+
+// InfluxHandler forwards a set of recorded meter values to InfluxDB using the
+// line protocol. The timestamp of every line is the time at which the meters
+// were polled.
+type InfluxHandler struct {
+
+	// URL is the InfluxDB endpoint where the values are written. HTTP URLs
+	// must contain the full write path along with its parameters (eg.
+	// http://localhost:8086/write?db=metrics or
+	// http://localhost:8086/api/v2/write?org=org&bucket=metrics) while
+	// udp://host:port URLs will send the lines over UDP. This field must be
+	// set.
+	URL string
+
+	// Token is used as the authorization token for the InfluxDB 2.x API.
+	Token string
+
+	// Rules are applied in order to the keys and the first matching rule
+	// determines the measurement name and the tags of the key. Keys which
+	// don't match any rules are used as is for the measurement name.
+	Rules []TagRule
+
+	// Tags are added to every line.
+	Tags map[string]string
+
+	// HTTPClient can be used to optionally customize the HTTPClient used to
+	// make the HTTP requests.
+	HTTPClient *http.Client
+
+	// MaxPacketSize is the maximum size of a datagram when sending over UDP.
+	// Defaults to DefaultInfluxPacketSize.
+	MaxPacketSize int
+
+	initialize sync.Once
+
+	mutex sync.Mutex
+	url   *url.URL
+	conn  net.Conn
+
+	clock clockRef
+}
+
+// NewInfluxHandler instantiates a new InfluxHandler which will write to the
+// given URL.
+func NewInfluxHandler(URL string) *InfluxHandler {
+	return &InfluxHandler{URL: URL}
+}
+
+// Init can be optionally used to initialize the object. Note that the handler
+// will lazily initialize itself as needed.
+func (handler *InfluxHandler) Init() {
+	handler.initialize.Do(handler.init)
+}
+
+// SetClock sets the clock used to timestamp the values passed to HandleMeters.
+func (handler *InfluxHandler) SetClock(clock Clock) {
+	handler.clock.Set(clock)
+}
+
+func (handler *InfluxHandler) init() {
+	if handler.URL == "" {
+		klog.KFatal("meter.influx.init.error", "no URL configured")
+	}
+
+	var err error
+	if handler.url, err = url.Parse(handler.URL); err != nil {
+		klog.KFatalf("meter.influx.init.error", "invalid URL '%s': %s", handler.URL, err)
+	}
+
+	switch handler.url.Scheme {
+	case "http", "https", "udp":
+	default:
+		klog.KFatalf("meter.influx.init.error", "unsupported scheme in URL '%s'", handler.URL)
+	}
+
+	if handler.HTTPClient == nil {
+		handler.HTTPClient = http.DefaultClient
+	}
+
+	if handler.MaxPacketSize == 0 {
+		handler.MaxPacketSize = DefaultInfluxPacketSize
+	}
+}
+
+// HandleMeters writes the given values to InfluxDB.
+func (handler *InfluxHandler) HandleMeters(values map[string]float64) {
+	handler.HandleSamples(newSamples(values, &handler.clock))
+}
+
+// HandleSamples writes the given samples to InfluxDB where the labels are
+// written as tags.
+func (handler *InfluxHandler) HandleSamples(samples []Sample) {
+	handler.Init()
+
+	lines := formatInflux(samples, handler.Rules, handler.Tags)
+	if len(lines) == 0 {
+		return
+	}
+
+	var err error
+	if handler.url.Scheme == "udp" {
+		err = handler.sendUDP(lines)
+	} else {
+		err = handler.sendHTTP(lines)
+	}
+
+	if err != nil {
+		klog.KPrintf("meter.influx.send.error", "error when sending to '%s': %s", handler.URL, err)
+	}
+}
+
+type influxPoint struct {
+	series string
+	ts     string
+	fields map[string]float64
+}
+
+// formatInflux formats the given samples as lines of the Influx line protocol
+// where the measurement and the tags of each sample are determined by the given
+// rules and static tags.
+func formatInflux(samples []Sample, rules []TagRule, staticTags map[string]string) []string {
+	points := make(map[string]*influxPoint)
+
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+
+		measurement, tags := applyTagRules(rules, sample.Key)
+
+		for label, value := range sample.Labels {
+			tags[label] = value
+		}
+
+		field := "value"
+		if name, ok := tags[InfluxFieldTag]; ok {
+			field = name
+			delete(tags, InfluxFieldTag)
+		}
+
+		for tag, tagValue := range staticTags {
+			if _, ok := tags[tag]; !ok {
+				tags[tag] = tagValue
+			}
+		}
+
+		ts := strconv.FormatInt(sample.Timestamp.UnixNano(), 10)
+		series := influxSeries(measurement, tags)
+
+		point, ok := points[series+" "+ts]
+		if !ok {
+			point = &influxPoint{series, ts, make(map[string]float64)}
+			points[series+" "+ts] = point
+		}
+		point.fields[field] = sample.Value
+	}
+
+	var lines []string
+	for _, point := range points {
+		lines = append(lines, point.series+" "+influxFields(point.fields)+" "+point.ts)
+	}
+
+	sort.Strings(lines)
+	return lines
+}
+
+func (handler *InfluxHandler) sendHTTP(lines []string) error {
+	body := strings.Join(lines, "\n") + "\n"
+
+	request, err := http.NewRequest("POST", handler.URL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if handler.Token != "" {
+		request.Header.Set("Authorization", "Token "+handler.Token)
+	}
+
+	response, err := handler.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("unexpected status '%s': %s", response.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+func (handler *InfluxHandler) sendUDP(lines []string) error {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	if handler.conn == nil {
+		conn, err := net.Dial("udp", handler.url.Host)
+		if err != nil {
+			return err
+		}
+		handler.conn = conn
+	}
+
+	for _, packet := range packLines(lines, handler.MaxPacketSize) {
+		if _, err := handler.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func influxSeries(measurement string, tags map[string]string) string {
+	var keys []string
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	series := influxEscape(measurement, ", ")
+	for _, key := range keys {
+		if tags[key] == "" {
+			continue
+		}
+		series += "," + influxEscape(key, ",= ") + "=" + influxEscape(tags[key], ",= ")
+	}
+
+	return series
+}
+
+func influxFields(fields map[string]float64) string {
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var result []string
+	for _, key := range keys {
+		value := strconv.FormatFloat(fields[key], 'g', -1, 64)
+		result = append(result, influxEscape(key, ",= ")+"="+value)
+	}
+
+	return strings.Join(result, ",")
+}
+
+func influxEscape(str, special string) string {
+	buffer := new(bytes.Buffer)
+
+	for _, c := range strings.Replace(str, "\n", " ", -1) {
+		if strings.ContainsRune(special, c) {
+			buffer.WriteByte('\\')
+		}
+		buffer.WriteRune(c)
+	}
+
+	return buffer.String()
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInfluxHandler(t *testing.T) {
+	bodyC := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if auth := request.Header.Get("Authorization"); auth != "Token secret" {
+			t.Errorf("FAIL: unexpected authorization '%s'", auth)
+		}
+
+		body, _ := ioutil.ReadAll(request.Body)
+		bodyC <- string(body)
+
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	handler := &InfluxHandler{
+		URL:   server.URL + "/api/v2/write?org=org&bucket=metrics",
+		Token: "secret",
+		Tags:  map[string]string{"host": "h0"},
+		Rules: []TagRule{
+			{
+				Pattern: "*.Histogram.*",
+				Name:    "{0}.Histogram",
+				Tags:    map[string]string{InfluxFieldTag: "{1}"},
+			},
+			{
+				Pattern: "*.Multi.*",
+				Name:    "{0}.Multi",
+				Tags:    map[string]string{"key": "{1}"},
+			},
+		},
+	}
+
+	handler.HandleMeters(map[string]float64{
+		"a.Counter":       10,
+		"a.Histogram.p50": 50,
+		"a.Histogram.p99": 99,
+		"a.Multi.x y":     1,
+		"a.Multi.z":       2,
+	})
+
+	lines := strings.Split(strings.TrimSpace(<-bodyC), "\n")
+
+	exp := []string{
+		"a.Counter,host=h0 value=10",
+		"a.Histogram,host=h0 p50=50,p99=99",
+		"a.Multi,host=h0,key=x\\ y value=1",
+		"a.Multi,host=h0,key=z value=2",
+	}
+
+	if len(lines) != len(exp) {
+		t.Fatalf("FAIL: line count mismatch %q != %q", lines, exp)
+	}
+
+	ts := ""
+	for i, line := range lines {
+		j := strings.LastIndex(line, " ")
+
+		if ts == "" {
+			ts = line[j+1:]
+		} else if ts != line[j+1:] {
+			t.Errorf("FAIL: timestamp mismatch '%s' != '%s'", line[j+1:], ts)
+		}
+
+		if line[:j] != exp[i] {
+			t.Errorf("FAIL: line mismatch '%s' != '%s'", line[:j], exp[i])
+		}
+	}
+}
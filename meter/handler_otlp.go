@@ -0,0 +1,312 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DefaultOTLPScope is the name of the instrumentation scope of the metrics
+// exported by OTLPEncoder.
+const DefaultOTLPScope = "github.com/datacratic/gometer/meter"
+
+// NewOTLPHandler returns an HTTPHandler which exports the polled values to the
+// metrics endpoint of an OpenTelemetry collector using OTLP/HTTP (eg.
+// http://localhost:4318/v1/metrics). The values are attributed to the given
+// service name and to the local host.
+func NewOTLPHandler(URL, serviceName string) *HTTPHandler {
+	host, _ := os.Hostname()
+
+	return &HTTPHandler{
+		URL:     URL,
+		Method:  "POST",
+		Encoder: OTLPEncoder{ServiceName: serviceName, HostName: host},
+	}
+}
+
+// OTLPEncoder encodes the samples as an OTLP ExportMetricsServiceRequest using
+// the JSON encoding of OTLP/HTTP.
+//
+// Counter rates are exported as delta sums of the events counted during the
+// polling interval, cumulative totals as cumulative sums and all other values
+// as gauges. Histogram statistics are grouped into a summary made of the
+// percentiles along with the count and sum (or avg) values while the remaining
+// statistics (eg. min, max) are exported as gauges. Labels are exported as
+// attributes and non-finite values are dropped.
+type OTLPEncoder struct {
+
+	// ServiceName is exported as the service.name resource attribute.
+	ServiceName string
+
+	// HostName is exported as the host.name resource attribute.
+	HostName string
+
+	// Attributes are additional resource attributes.
+	Attributes map[string]string
+
+	// StartTime is the start time of the cumulative totals which is omitted
+	// if not set. HTTPHandler sets it to the time given by its clock when it
+	// is initialized.
+	StartTime time.Time
+}
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Unit        string       `json:"unit,omitempty"`
+	Gauge       *otlpGauge   `json:"gauge,omitempty"`
+	Sum         *otlpSum     `json:"sum,omitempty"`
+	Summary     *otlpSummary `json:"summary,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+// Values of the AggregationTemporality enum.
+const (
+	otlpDelta      = 1
+	otlpCumulative = 2
+)
+
+type otlpSum struct {
+	DataPoints             []otlpNumberPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type otlpNumberPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpSummary struct {
+	DataPoints []*otlpSummaryPoint `json:"dataPoints"`
+}
+
+type otlpSummaryPoint struct {
+	Attributes     []otlpAttribute `json:"attributes,omitempty"`
+	TimeUnixNano   string          `json:"timeUnixNano"`
+	Count          string          `json:"count"`
+	Sum            float64         `json:"sum"`
+	QuantileValues []otlpQuantile  `json:"quantileValues,omitempty"`
+
+	count, sum, avg float64
+	hasSum, hasAvg  bool
+}
+
+type otlpQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// Encode encodes the given batches of samples.
+func (encoder OTLPEncoder) Encode(batches [][]Sample, header http.Header) ([]byte, error) {
+	header.Set("Content-Type", "application/json")
+
+	metrics := make(map[string]*otlpMetric)
+
+	metric := func(name string, sample Sample) *otlpMetric {
+		if metrics[name] == nil {
+			metrics[name] = &otlpMetric{Name: name, Description: sample.Help, Unit: sample.Unit}
+		}
+		return metrics[name]
+	}
+
+	for _, samples := range batches {
+		summaries := summaryKeys(samples)
+		points := make(map[string]*otlpSummaryPoint)
+
+		for _, sample := range samples {
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				continue
+			}
+
+			base, suffix := splitSuffix(sample.Key)
+
+			if !summaries[base] {
+				encoder.addNumber(metric(sample.Key, sample), sample)
+				continue
+			}
+
+			q, isQuantile := parsePercentile(suffix)
+			if !isQuantile && suffix != "count" && suffix != "sum" && suffix != "avg" {
+				encoder.addNumber(metric(sample.Key, sample), sample)
+				continue
+			}
+
+			id := base + sample.Labels.key()
+
+			point := points[id]
+			if point == nil {
+				point = &otlpSummaryPoint{
+					Attributes:   otlpAttributes(sample.Labels),
+					TimeUnixNano: otlpTime(sample.Timestamp),
+				}
+				points[id] = point
+
+				m := metric(base, sample)
+				if m.Summary == nil {
+					m.Summary = &otlpSummary{}
+				}
+				m.Summary.DataPoints = append(m.Summary.DataPoints, point)
+			}
+
+			switch {
+			case isQuantile:
+				point.QuantileValues = append(point.QuantileValues, otlpQuantile{Quantile: q, Value: sample.Value})
+			case suffix == "count":
+				point.count = sample.Value
+			case suffix == "sum":
+				point.sum, point.hasSum = sample.Value, true
+			case suffix == "avg":
+				point.avg, point.hasAvg = sample.Value, true
+			}
+		}
+
+		for _, point := range points {
+			if !point.hasSum && point.hasAvg {
+				point.sum = point.avg * point.count
+			}
+
+			point.Count = strconv.FormatUint(uint64(point.count), 10)
+			point.Sum = point.sum
+
+			sort.Slice(point.QuantileValues, func(i, j int) bool {
+				return point.QuantileValues[i].Quantile < point.QuantileValues[j].Quantile
+			})
+		}
+	}
+
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	scope := otlpScopeMetrics{Scope: otlpScope{Name: DefaultOTLPScope}, Metrics: []*otlpMetric{}}
+	for _, name := range names {
+		scope.Metrics = append(scope.Metrics, metrics[name])
+	}
+
+	request := otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResource{Attributes: encoder.resource()},
+		ScopeMetrics: []otlpScopeMetrics{scope},
+	}}}
+
+	return json.Marshal(request)
+}
+
+func (encoder OTLPEncoder) resource() []otlpAttribute {
+	attributes := make(Labels)
+
+	for key, value := range encoder.Attributes {
+		attributes[key] = value
+	}
+
+	if encoder.ServiceName != "" {
+		attributes["service.name"] = encoder.ServiceName
+	}
+
+	if encoder.HostName != "" {
+		attributes["host.name"] = encoder.HostName
+	}
+
+	return otlpAttributes(attributes)
+}
+
+// addNumber adds the sample to the given metric as a sum or gauge data point
+// depending on its kind.
+func (encoder OTLPEncoder) addNumber(metric *otlpMetric, sample Sample) {
+	point := otlpNumberPoint{
+		Attributes:   otlpAttributes(sample.Labels),
+		TimeUnixNano: otlpTime(sample.Timestamp),
+		AsDouble:     sample.Value,
+	}
+
+	switch sample.Kind {
+
+	case KindCounter:
+		interval := sample.Interval
+		if interval == 0 {
+			interval = 1 * time.Second
+		}
+
+		point.StartTimeUnixNano = otlpTime(sample.Timestamp.Add(-interval))
+		point.AsDouble = sample.Value * interval.Seconds()
+
+		if metric.Sum == nil {
+			metric.Sum = &otlpSum{AggregationTemporality: otlpDelta, IsMonotonic: true}
+		}
+		metric.Sum.DataPoints = append(metric.Sum.DataPoints, point)
+
+	case KindTotal:
+		if !encoder.StartTime.IsZero() {
+			point.StartTimeUnixNano = otlpTime(encoder.StartTime)
+		}
+
+		if metric.Sum == nil {
+			metric.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		}
+		metric.Sum.DataPoints = append(metric.Sum.DataPoints, point)
+
+	default:
+		if metric.Gauge == nil {
+			metric.Gauge = &otlpGauge{}
+		}
+		metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, point)
+	}
+}
+
+func otlpAttributes(labels Labels) []otlpAttribute {
+	var attributes []otlpAttribute
+
+	for _, name := range labels.Names() {
+		attributes = append(attributes, otlpAttribute{Key: name, Value: otlpValue{StringValue: labels[name]}})
+	}
+
+	return attributes
+}
+
+func otlpTime(ts time.Time) string {
+	return strconv.FormatInt(ts.UnixNano(), 10)
+}
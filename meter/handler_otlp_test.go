@@ -0,0 +1,97 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOTLPHandler(t *testing.T) {
+	bodyC := make(chan []byte, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/v1/metrics" || request.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("FAIL: unexpected request %s %s", request.URL.Path, request.Header.Get("Content-Type"))
+		}
+
+		body, _ := ioutil.ReadAll(request.Body)
+		bodyC <- body
+	}))
+	defer server.Close()
+
+	handler := NewOTLPHandler(server.URL+"/v1/metrics", "svc")
+	handler.Encoder = OTLPEncoder{ServiceName: "svc", HostName: "host"}
+
+	// The start time of the cumulative totals is taken from the clock of the
+	// handler when it's initialized.
+	handler.SetClock(TestClock{Time: time.Unix(500, 0)})
+
+	ts := time.Unix(1000, 0)
+	handler.HandleSamples([]Sample{
+		{Key: "req", Labels: Labels{"code": "200"}, Value: 5, Kind: KindCounter, Timestamp: ts, Interval: 2 * time.Second},
+		{Key: "total", Value: 42, Kind: KindTotal, Timestamp: ts},
+		{Key: "mem", Value: 7, Kind: KindGauge, Unit: "bytes", Timestamp: ts},
+		{Key: "lat.count", Value: 10, Kind: KindHistogram, Timestamp: ts},
+		{Key: "lat.avg", Value: 3, Kind: KindHistogram, Timestamp: ts},
+		{Key: "lat.max", Value: 9, Kind: KindHistogram, Timestamp: ts},
+		{Key: "lat.p99", Value: 8, Kind: KindPercentile, Timestamp: ts},
+		{Key: "lat.p50", Value: 2, Kind: KindPercentile, Timestamp: ts},
+	})
+
+	var request otlpRequest
+	if err := json.Unmarshal(<-bodyC, &request); err != nil {
+		t.Fatalf("FAIL: invalid body: %s", err)
+	}
+
+	resource := request.ResourceMetrics[0].Resource.Attributes
+	if len(resource) != 2 || resource[0].Key != "host.name" || resource[1].Value.StringValue != "svc" {
+		t.Errorf("FAIL: unexpected resource %+v", resource)
+	}
+
+	metrics := make(map[string]*otlpMetric)
+	for _, metric := range request.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[metric.Name] = metric
+	}
+
+	if len(metrics) != 5 {
+		t.Errorf("FAIL: unexpected metrics %v", metrics)
+	}
+
+	if sum := metrics["req"].Sum; sum == nil || sum.AggregationTemporality != otlpDelta || !sum.IsMonotonic {
+		t.Errorf("FAIL: expected delta sum %+v", metrics["req"])
+
+	} else if point := sum.DataPoints[0]; point.AsDouble != 10 ||
+		point.StartTimeUnixNano != "998000000000" || point.TimeUnixNano != "1000000000000" ||
+		point.Attributes[0].Key != "code" || point.Attributes[0].Value.StringValue != "200" {
+		t.Errorf("FAIL: unexpected delta point %+v", point)
+	}
+
+	if sum := metrics["total"].Sum; sum == nil || sum.AggregationTemporality != otlpCumulative || sum.DataPoints[0].AsDouble != 42 {
+		t.Errorf("FAIL: expected cumulative sum %+v", metrics["total"])
+
+	} else if start := sum.DataPoints[0].StartTimeUnixNano; start != "500000000000" {
+		t.Errorf("FAIL: unexpected cumulative start time '%s'", start)
+	}
+
+	if gauge := metrics["mem"].Gauge; gauge == nil || gauge.DataPoints[0].AsDouble != 7 || metrics["mem"].Unit != "bytes" {
+		t.Errorf("FAIL: expected gauge %+v", metrics["mem"])
+	}
+
+	if gauge := metrics["lat.max"].Gauge; gauge == nil || gauge.DataPoints[0].AsDouble != 9 {
+		t.Errorf("FAIL: expected max gauge %+v", metrics["lat.max"])
+	}
+
+	if summary := metrics["lat"].Summary; summary == nil || len(summary.DataPoints) != 1 {
+		t.Errorf("FAIL: expected summary %+v", metrics["lat"])
+
+	} else if point := summary.DataPoints[0]; point.Count != "10" || point.Sum != 30 ||
+		len(point.QuantileValues) != 2 || point.QuantileValues[0] != (otlpQuantile{0.5, 2}) ||
+		point.QuantileValues[1] != (otlpQuantile{0.99, 8}) {
+		t.Errorf("FAIL: unexpected summary point %+v", point)
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultPathPrometheus is used as the value of Path in PrometheusHandler if no
+// values are provided.
+const DefaultPathPrometheus = "/metrics"
+
+// PrometheusHandler exposes the last polled values in the Prometheus text
+// exposition format.
+//
+// Keys are converted to valid Prometheus metric names by replacing any invalid
+// characters with underscores and labels are exposed as Prometheus labels.
+// Histogram percentiles (p50, p90, p99, etc.) are grouped into a summary with a
+// quantile label along with the _count and _sum series derived from the count
+// and sum (or avg) values. Cumulative totals are exposed as counters, counter
+// rates and gauges are exposed as gauges while values without any type
+// information are exposed as untyped metrics.
+//
+// The last values polled by each poller are kept separately such that a handler
+// shared by a poller and its groups exposes the values of all of them.
+type PrometheusHandler struct {
+
+	// Path is the HTTP path where the metrics will be served by
+	// NewPrometheusHandler.
+	Path string
+
+	mutex sync.Mutex
+	last  map[*Poller][]Sample
+}
+
+// NewPrometheusHandler creates a new Prometheus endpoint and registers it with
+// the default net/http ServeMux.
+func NewPrometheusHandler(path string) *PrometheusHandler {
+	handler := &PrometheusHandler{Path: path}
+
+	if path == "" {
+		path = DefaultPathPrometheus
+	}
+	http.Handle(path, handler)
+
+	return handler
+}
+
+// HandleMeters records the aggregated metrics to be served by the Prometheus
+// endpoint.
+func (handler *PrometheusHandler) HandleMeters(values map[string]float64) {
+	handler.HandleSamples(toSamples(values, KindUntyped, "", ""))
+}
+
+// HandleSamples records the aggregated samples to be served by the Prometheus
+// endpoint.
+func (handler *PrometheusHandler) HandleSamples(samples []Sample) {
+	handler.handleSnapshot(nil, samples)
+}
+
+func (handler *PrometheusHandler) handleSnapshot(source *Poller, samples []Sample) {
+	handler.mutex.Lock()
+
+	if handler.last == nil {
+		handler.last = make(map[*Poller][]Sample)
+	}
+	handler.last[source] = samples
+
+	handler.mutex.Unlock()
+}
+
+// ServeHTTP writes the last seen set of metrics in the Prometheus text
+// exposition format.
+func (handler *PrometheusHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	handler.mutex.Lock()
+
+	var samples []Sample
+	for _, last := range handler.last {
+		samples = append(samples, last...)
+	}
+
+	handler.mutex.Unlock()
+
+	body := formatPrometheus(samples)
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer.Write(body)
+}
+
+type promFamily struct {
+	name    string
+	typ     string
+	help    string
+	samples []promSample
+}
+
+type promSample struct {
+	name     string
+	labels   Labels
+	quantile string
+	order    float64
+	value    float64
+}
+
+func formatPrometheus(samples []Sample) []byte {
+	families := make(map[string]*promFamily)
+
+	convertPrometheus(samples, func(family, typ string, source Sample, sample promSample) {
+		if families[family] == nil {
+			families[family] = &promFamily{name: family, typ: typ, help: source.Help}
+		}
+		families[family].samples = append(families[family].samples, sample)
+	})
+
+	var names []string
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buffer := new(bytes.Buffer)
+
+	for _, name := range names {
+		family := families[name]
+
+		sort.Sort(promSamples(family.samples))
+
+		if family.help != "" {
+			buffer.WriteString("# HELP " + family.name + " " + promHelp(family.help) + "\n")
+		}
+		buffer.WriteString("# TYPE " + family.name + " " + family.typ + "\n")
+
+		for _, sample := range family.samples {
+			labels := promLabels(sample.labels, sample.quantile)
+			buffer.WriteString(sample.name + labels + " " + promValue(sample.value) + "\n")
+		}
+	}
+
+	return buffer.Bytes()
+}
+
+// convertPrometheus converts the given samples into Prometheus samples where
+// histogram percentiles are grouped into summaries. The add function is called
+// with the name and type of the family of every converted sample along with the
+// sample it was converted from.
+func convertPrometheus(samples []Sample, add func(family, typ string, source Sample, sample promSample)) {
+	summaries := summaryKeys(samples)
+	counts := make(map[string]float64)
+	sums := make(map[string]bool)
+
+	for _, sample := range samples {
+		base, suffix := splitSuffix(sample.Key)
+		if base == "" {
+			continue
+		}
+
+		switch suffix {
+		case "count":
+			counts[base+sample.Labels.key()] = sample.Value
+		case "sum":
+			sums[base+sample.Labels.key()] = true
+		}
+	}
+
+	for _, sample := range samples {
+		base, suffix := splitSuffix(sample.Key)
+		labels := sample.Labels
+
+		if !summaries[base] {
+			typ := "untyped"
+			switch sample.Kind {
+			case KindCounter, KindGauge:
+				typ = "gauge"
+			case KindTotal:
+				typ = "counter"
+			}
+
+			name := promName(sample.Key)
+			add(name, typ, sample, promSample{name: name, labels: labels, value: sample.Value})
+			continue
+		}
+
+		name := promName(base)
+
+		if q, ok := parsePercentile(suffix); ok {
+			quantile := strconv.FormatFloat(q, 'g', -1, 64)
+			add(name, "summary", sample, promSample{name: name, labels: labels, quantile: quantile, order: q, value: sample.Value})
+			continue
+		}
+
+		switch suffix {
+
+		case "count":
+			add(name, "summary", sample, promSample{name: name + "_count", labels: labels, order: 3, value: sample.Value})
+
+		case "sum":
+			add(name, "summary", sample, promSample{name: name + "_sum", labels: labels, order: 2, value: sample.Value})
+
+		case "avg":
+			if sums[base+sample.Labels.key()] {
+				continue
+			}
+
+			if count, ok := counts[base+sample.Labels.key()]; ok {
+				add(name, "summary", sample, promSample{name: name + "_sum", labels: labels, order: 2, value: sample.Value * count})
+			}
+
+		default:
+			add(name+"_"+suffix, "gauge", sample, promSample{name: name + "_" + suffix, labels: labels, value: sample.Value})
+		}
+	}
+}
+
+// summaryKeys returns the set of keys whose statistics should be exported as a
+// summary which are the keys of histograms along with the keys of untyped
+// values that have a percentile suffix (eg. p99).
+func summaryKeys(samples []Sample) map[string]bool {
+	summaries := make(map[string]bool)
+
+	for _, sample := range samples {
+		base, suffix := splitSuffix(sample.Key)
+		if base == "" {
+			continue
+		}
+
+		switch sample.Kind {
+
+		case KindHistogram, KindPercentile:
+			summaries[base] = true
+
+		case KindUntyped:
+			if _, ok := parsePercentile(suffix); ok {
+				summaries[base] = true
+			}
+		}
+	}
+
+	return summaries
+}
+
+type promSamples []promSample
+
+func (array promSamples) Len() int      { return len(array) }
+func (array promSamples) Swap(i, j int) { array[i], array[j] = array[j], array[i] }
+func (array promSamples) Less(i, j int) bool {
+	if a, b := array[i].labels.String(), array[j].labels.String(); a != b {
+		return a < b
+	}
+	if array[i].order != array[j].order {
+		return array[i].order < array[j].order
+	}
+	return array[i].name < array[j].name
+}
+
+// promLabels formats the given labels along with the optional quantile label.
+func promLabels(labels Labels, quantile string) string {
+	var pairs []string
+
+	for _, name := range labels.Names() {
+		pairs = append(pairs, promLabelName(name)+"=\""+promLabelValue(labels[name])+"\"")
+	}
+
+	if quantile != "" {
+		pairs = append(pairs, "quantile=\""+quantile+"\"")
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// splitSuffix splits a key into the part before the last '.' character and the
+// part after it.
+func splitSuffix(key string) (base string, suffix string) {
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// promLabelName converts a label name into a valid Prometheus label name by
+// replacing all invalid characters with underscores.
+func promLabelName(name string) string {
+	return strings.Replace(promName(name), ":", "_", -1)
+}
+
+func promHelp(help string) string {
+	help = strings.Replace(help, `\`, `\\`, -1)
+	return strings.Replace(help, "\n", `\n`, -1)
+}
+
+func promLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+// promName converts a key into a valid Prometheus metric name by replacing all
+// invalid characters with underscores.
+func promName(key string) string {
+	name := []byte(key)
+
+	for i, c := range name {
+		valid := c == '_' || c == ':' ||
+			(c >= 'a' && c <= 'z') ||
+			(c >= 'A' && c <= 'Z') ||
+			(i > 0 && c >= '0' && c <= '9')
+
+		if !valid {
+			name[i] = '_'
+		}
+	}
+
+	if len(name) == 0 {
+		return "_"
+	}
+
+	return string(name)
+}
+
+func promValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
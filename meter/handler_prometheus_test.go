@@ -0,0 +1,121 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	handler := &PrometheusHandler{}
+
+	handler.HandleMeters(map[string]float64{
+		"a.Counter":         10,
+		"a.State.happy":     1,
+		"a.Histogram.p50":   50,
+		"a.Histogram.p90":   90,
+		"a.Histogram.p99":   99,
+		"a.Histogram.avg":   49.5,
+		"a.Histogram.min":   0,
+		"a.Histogram.max":   99,
+		"a.Histogram.count": 100,
+		"a.Multi-Key.1":     0.5,
+	})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	exp := "# TYPE a_Counter untyped\n" +
+		"a_Counter 10\n" +
+		"# TYPE a_Histogram summary\n" +
+		"a_Histogram{quantile=\"0.5\"} 50\n" +
+		"a_Histogram{quantile=\"0.9\"} 90\n" +
+		"a_Histogram{quantile=\"0.99\"} 99\n" +
+		"a_Histogram_sum 4950\n" +
+		"a_Histogram_count 100\n" +
+		"# TYPE a_Histogram_max gauge\n" +
+		"a_Histogram_max 99\n" +
+		"# TYPE a_Histogram_min gauge\n" +
+		"a_Histogram_min 0\n" +
+		"# TYPE a_Multi_Key_1 untyped\n" +
+		"a_Multi_Key_1 0.5\n" +
+		"# TYPE a_State_happy untyped\n" +
+		"a_State_happy 1\n"
+
+	if body := recorder.Body.String(); body != exp {
+		t.Errorf("FAIL: body mismatch\n%s\n!=\n%s", body, exp)
+	}
+}
+
+func TestPrometheusHandler_Labels(t *testing.T) {
+	handler := &PrometheusHandler{}
+
+	handler.HandleSamples([]Sample{
+		{Key: "a.Counter", Labels: Labels{"status": "5\"00"}, Value: 1},
+		{Key: "a.Counter", Labels: Labels{"status": "200"}, Value: 2},
+		{Key: "a.Histogram.p50", Labels: Labels{"route": "x"}, Value: 50},
+		{Key: "a.Histogram.count", Labels: Labels{"route": "x"}, Value: 10},
+		{Key: "a.Histogram.avg", Labels: Labels{"route": "x"}, Value: 2},
+	})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	exp := "# TYPE a_Counter untyped\n" +
+		"a_Counter{status=\"200\"} 2\n" +
+		"a_Counter{status=\"5\\\"00\"} 1\n" +
+		"# TYPE a_Histogram summary\n" +
+		"a_Histogram{route=\"x\",quantile=\"0.5\"} 50\n" +
+		"a_Histogram_sum{route=\"x\"} 20\n" +
+		"a_Histogram_count{route=\"x\"} 10\n"
+
+	if body := recorder.Body.String(); body != exp {
+		t.Errorf("FAIL: body mismatch\n%s\n!=\n%s", body, exp)
+	}
+}
+
+func TestParsePercentile(t *testing.T) {
+	check := func(suffix string, exp float64, expOk bool) {
+		if value, ok := parsePercentile(suffix); ok != expOk || value != exp {
+			t.Errorf("FAIL(%s): %f, %v != %f, %v", suffix, value, ok, exp, expOk)
+		}
+	}
+
+	check("p50", 0.5, true)
+	check("p99", 0.99, true)
+	check("p999", 0.999, true)
+	check("p9999", 0.9999, true)
+	check("p5", 0.05, true)
+	check("p100", 1, true)
+
+	check("p", 0, false)
+	check("max", 0, false)
+	check("p9x", 0, false)
+}
+
+func TestPrometheusHandler_Stats(t *testing.T) {
+	handler := &PrometheusHandler{}
+
+	handler.HandleSamples([]Sample{
+		{Key: "h.p999", Value: 9, Kind: KindPercentile},
+		{Key: "h.count", Value: 4, Kind: KindHistogram},
+		{Key: "h.avg", Value: 2, Kind: KindHistogram},
+		{Key: "h.sum", Value: 7, Kind: KindHistogram},
+		{Key: "h.stddev", Value: 1.5, Kind: KindHistogram},
+	})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	exp := "# TYPE h summary\n" +
+		"h{quantile=\"0.999\"} 9\n" +
+		"h_sum 7\n" +
+		"h_count 4\n" +
+		"# TYPE h_stddev gauge\n" +
+		"h_stddev 1.5\n"
+
+	if body := recorder.Body.String(); body != exp {
+		t.Errorf("FAIL: body mismatch\n%s\n!=\n%s", body, exp)
+	}
+}
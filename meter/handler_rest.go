@@ -14,6 +14,8 @@ import (
 const DefaultPathREST = "/debug/meter"
 
 // RESTHandler provides a REST interface for the values polled from the meters.
+// The last values polled by each poller are kept separately such that a handler
+// shared by a poller and its groups exposes the values of all of them.
 type RESTHandler struct {
 
 	// PathPrefix is the HTTP base path where the REST interface will be
@@ -21,7 +23,7 @@ type RESTHandler struct {
 	PathPrefix string
 
 	mutex sync.Mutex
-	last  map[string]float64
+	last  map[*Poller]map[string]float64
 }
 
 // NewRESTHandler creates a new REST interface and registers it with the default
@@ -49,22 +51,27 @@ func (handler *RESTHandler) RESTRoutes() rest.Routes {
 
 // HandleMeters records the aggregated metrics to be used by the REST interface.
 func (handler *RESTHandler) HandleMeters(meters map[string]float64) {
-	handler.mutex.Lock()
-
-	handler.last = meters
+	handler.handleMeters(nil, meters)
+}
 
-	handler.mutex.Unlock()
+func (handler *RESTHandler) handleSnapshot(source *Poller, samples []Sample) {
+	handler.handleMeters(source, FlattenSamples(samples))
 }
 
-// Get returns the last seen set of metrics.
-func (handler *RESTHandler) Get() map[string]float64 {
+func (handler *RESTHandler) handleMeters(source *Poller, meters map[string]float64) {
 	handler.mutex.Lock()
 
-	result := handler.last
+	if handler.last == nil {
+		handler.last = make(map[*Poller]map[string]float64)
+	}
+	handler.last[source] = meters
 
 	handler.mutex.Unlock()
+}
 
-	return result
+// Get returns a copy of the last seen set of metrics.
+func (handler *RESTHandler) Get() map[string]float64 {
+	return handler.get(func(string) bool { return true })
 }
 
 // GetPrefix returns the set of metrics filtered to have the given prefix.
@@ -95,9 +102,11 @@ func (handler *RESTHandler) get(filter func(string) bool) map[string]float64 {
 
 	result := make(map[string]float64)
 
-	for key, value := range handler.last {
-		if filter(key) {
-			result[key] = value
+	for _, last := range handler.last {
+		for key, value := range last {
+			if filter(key) {
+				result[key] = value
+			}
 		}
 	}
 
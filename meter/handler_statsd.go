@@ -0,0 +1,190 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"github.com/datacratic/goklog/klog"
+
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStatsDPacketSize is used if MaxPacketSize is not set in StatsDHandler.
+// It's small enough to avoid fragmentation on most networks.
+const DefaultStatsDPacketSize = 1432
+
+// StatsDHandler forwards a set of recorded meter values to a StatsD or DogStatsD
+// agent over UDP. Lines are batched into datagrams of at most MaxPacketSize
+// bytes.
+//
+// Counters are sent as StatsD counters (|c) where the count is recovered from
+// the per second rate and the polling interval. Everything else is sent as a
+// gauge (|g) which includes states and histogram statistics.
+type StatsDHandler struct {
+
+	// URL is the address of the StatsD agent. This field must be set.
+	URL string
+
+	// DogStatsD enables the DogStatsD extensions which are required to send
+	// Tags.
+	DogStatsD bool
+
+	// Tags are appended to every line sent when DogStatsD is set. Tags are
+	// usually of the form "key:value".
+	Tags []string
+
+	// MaxPacketSize is the maximum size of a datagram sent to the agent.
+	// Defaults to DefaultStatsDPacketSize.
+	MaxPacketSize int
+
+	initialize sync.Once
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+// NewStatsDHandler instantiates a new StatsDHandler which will send to the given
+// URL.
+func NewStatsDHandler(URL string) *StatsDHandler {
+	return &StatsDHandler{URL: URL}
+}
+
+// Init can be optionally used to initialize the object. Note that the handler
+// will lazily initialize itself as needed.
+func (handler *StatsDHandler) Init() {
+	handler.initialize.Do(handler.init)
+}
+
+func (handler *StatsDHandler) init() {
+	if handler.URL == "" {
+		klog.KFatal("meter.statsd.init.error", "no URL configured")
+	}
+
+	if handler.MaxPacketSize == 0 {
+		handler.MaxPacketSize = DefaultStatsDPacketSize
+	}
+}
+
+// HandleMeters sends the given values to the StatsD agent.
+func (handler *StatsDHandler) HandleMeters(values map[string]float64) {
+	handler.HandleSamples(toSamples(values, KindUntyped, "", ""))
+}
+
+// HandleSamples sends the given samples to the StatsD agent. Labels are sent as
+// tags if DogStatsD is set or are otherwise flattened into the key.
+func (handler *StatsDHandler) HandleSamples(samples []Sample) {
+	handler.Init()
+
+	var lines []string
+	for _, sample := range samples {
+		lines = append(lines, handler.format(sample))
+	}
+	sort.Strings(lines)
+
+	handler.send(packLines(lines, handler.MaxPacketSize))
+}
+
+func (handler *StatsDHandler) format(sample Sample) string {
+	key, value := sample.Key, sample.Value
+	tags := handler.Tags
+
+	if handler.DogStatsD {
+		if len(sample.Labels) > 0 {
+			tags = append([]string(nil), handler.Tags...)
+		}
+
+		for _, name := range sample.Labels.Names() {
+			tags = append(tags, statsdEscape(name)+":"+statsdEscape(sample.Labels[name]))
+		}
+
+	} else {
+		key = sample.FlatKey()
+	}
+
+	key = statsdEscape(key)
+
+	suffix := ""
+	if handler.DogStatsD && len(tags) > 0 {
+		suffix = "|#" + strings.Join(tags, ",")
+	}
+
+	if sample.Kind == KindCounter {
+		value *= float64(sample.Interval) / float64(time.Second)
+		return key + ":" + statsdValue(value) + "|c" + suffix
+	}
+
+	line := key + ":" + statsdValue(value) + "|g" + suffix
+
+	// A leading sign on a gauge is interpreted as a relative change so negative
+	// values require that the gauge be reset first.
+	if value < 0 {
+		line = key + ":0|g" + suffix + "\n" + line
+	}
+
+	return line
+}
+
+func (handler *StatsDHandler) send(packets [][]byte) {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	if handler.conn == nil {
+		conn, err := net.Dial("udp", handler.URL)
+		if err != nil {
+			klog.KPrintf("meter.statsd.dial.error", "unable to connect to '%s': %s", handler.URL, err)
+			return
+		}
+		handler.conn = conn
+	}
+
+	for _, packet := range packets {
+		if _, err := handler.conn.Write(packet); err != nil {
+			klog.KPrintf("meter.statsd.send.error", "error when sending to '%s': %s", handler.URL, err)
+			return
+		}
+	}
+}
+
+func statsdEscape(key string) string {
+	return strings.Map(func(c rune) rune {
+		switch c {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return c
+	}, key)
+}
+
+func statsdValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// packLines groups the given newline separated lines into packets which are at
+// most size bytes long. Lines which don't fit within a single packet are sent
+// in a packet of their own.
+func packLines(lines []string, size int) (packets [][]byte) {
+	packet := new(bytes.Buffer)
+
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > size {
+			packets = append(packets, packet.Bytes())
+			packet = new(bytes.Buffer)
+		}
+
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	if packet.Len() > 0 {
+		packets = append(packets, packet.Bytes())
+	}
+
+	return
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDHandler(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("FATAL: unable to listen: %s", err)
+	}
+	defer conn.Close()
+
+	handler := &StatsDHandler{
+		URL:           conn.LocalAddr().String(),
+		DogStatsD:     true,
+		Tags:          []string{"env:test"},
+		MaxPacketSize: 64,
+	}
+
+	interval := 10 * time.Second
+
+	handler.HandleSamples([]Sample{
+		{Key: "a.Counter", Value: 1.5, Kind: KindCounter, Interval: interval},
+		{Key: "a.Gauge", Value: -2, Kind: KindGauge, Interval: interval},
+		{Key: "a.State.happy", Value: 1, Kind: KindGauge, Interval: interval},
+		{Key: "a.Histogram.p99", Value: 99, Kind: KindPercentile, Interval: interval},
+		{Key: "a.Multi", Labels: Labels{"k": "v"}, Value: 2, Kind: KindCounter, Interval: interval},
+	})
+
+	exp := []string{
+		"a.Counter:15|c|#env:test",
+		"a.Gauge:0|g|#env:test",
+		"a.Gauge:-2|g|#env:test",
+		"a.Histogram.p99:99|g|#env:test",
+		"a.Multi:20|c|#env:test,k:v",
+		"a.State.happy:1|g|#env:test",
+	}
+
+	var lines []string
+	buffer := make([]byte, 1024)
+
+	for len(lines) < len(exp) {
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("FATAL: unable to read: %s", err)
+		}
+
+		if n > handler.MaxPacketSize {
+			t.Errorf("FAIL: packet too large %d > %d", n, handler.MaxPacketSize)
+		}
+
+		lines = append(lines, strings.Split(string(buffer[:n]), "\n")...)
+	}
+
+	if len(lines) != len(exp) {
+		t.Fatalf("FAIL: line count mismatch %v != %v", lines, exp)
+	}
+
+	for i := range exp {
+		if lines[i] != exp[i] {
+			t.Errorf("FAIL: line mismatch '%s' != '%s'", lines[i], exp[i])
+		}
+	}
+}
+
+func TestPackLines(t *testing.T) {
+	packets := packLines([]string{"aaaa", "bbbb", "cc", "dddddddddd"}, 9)
+
+	exp := []string{"aaaa\nbbbb", "cc", "dddddddddd"}
+	if len(packets) != len(exp) {
+		t.Fatalf("FAIL: packet count mismatch %q != %q", packets, exp)
+	}
+
+	for i := range exp {
+		if string(packets[i]) != exp[i] {
+			t.Errorf("FAIL: packet mismatch %q != %q", packets[i], exp[i])
+		}
+	}
+}
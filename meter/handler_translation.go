@@ -2,16 +2,19 @@
 
 package meter
 
-import (
-	"fmt"
-	"strings"
-)
+import ()
 
+// TranslationHandler adds a copy of every value whose key matches one of its
+// patterns under the key produced by the pattern's output template. Whether it's
+// registered via Handle or Transform, the Poller applies it as a Transformer
+// such that the translated keys are seen by every handler.
 type TranslationHandler struct {
 	input  []Pattern
 	output []string
 }
 
+// NewTranslationHandler creates a new TranslationHandler from the given map of
+// input patterns to output templates.
 func NewTranslationHandler(patterns map[string]string) *TranslationHandler {
 	handler := &TranslationHandler{}
 
@@ -23,6 +26,8 @@ func NewTranslationHandler(patterns map[string]string) *TranslationHandler {
 	return handler
 }
 
+// HandleMeters adds the translated keys to the given values. Not called by the
+// Poller which uses Transform instead.
 func (handler *TranslationHandler) HandleMeters(values map[string]float64) {
 	for key, value := range values {
 		if newKey, ok := handler.apply(key); ok {
@@ -31,6 +36,21 @@ func (handler *TranslationHandler) HandleMeters(values map[string]float64) {
 	}
 }
 
+// Transform returns the given samples along with a copy of every sample whose
+// flattened key was translated.
+func (handler *TranslationHandler) Transform(samples []Sample) []Sample {
+	result := append([]Sample(nil), samples...)
+
+	for _, sample := range samples {
+		if newKey, ok := handler.apply(sample.FlatKey()); ok {
+			sample.Key, sample.Labels, sample.suffixLen = newKey, nil, 0
+			result = append(result, sample)
+		}
+	}
+
+	return result
+}
+
 func (handler *TranslationHandler) apply(key string) (string, bool) {
 	for i, in := range handler.input {
 		groups, ok := in.Match(key)
@@ -38,12 +58,7 @@ func (handler *TranslationHandler) apply(key string) (string, bool) {
 			continue
 		}
 
-		newKey := handler.output[i]
-		for i, group := range groups {
-			newKey = strings.Replace(newKey, fmt.Sprintf("{%d}", i), group, -1)
-		}
-
-		return newKey, true
+		return expandGroups(handler.output[i], groups), true
 	}
 
 	return key, false
@@ -0,0 +1,81 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Labels associates dimensions to a meter value. Unlike the segments of a key,
+// labels keep their names which allows label-aware handlers to output them as
+// tags. Labels should not be modified once they've been passed to a meter.
+type Labels map[string]string
+
+// Names returns the sorted list of label names.
+func (labels Labels) Names() []string {
+	var names []string
+
+	for name := range labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Flatten returns the label values, sorted by label names, concatenated with a
+// '.' character. This is used to form the key of a labeled value for handlers
+// that are not aware of labels.
+func (labels Labels) Flatten() string {
+	var values []string
+
+	for _, name := range labels.Names() {
+		values = append(values, labels[name])
+	}
+
+	return Join(values...)
+}
+
+// String returns a canonical representation of the labels.
+func (labels Labels) String() string {
+	var pairs []string
+
+	for _, name := range labels.Names() {
+		pairs = append(pairs, name+"="+labels[name])
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// key returns an unambiguous representation of the labels where the names and
+// values are quoted. Unlike String, two different sets of labels never produce
+// the same key which makes it suitable to identify the meters of a set of
+// labels.
+func (labels Labels) key() string {
+	buffer := []byte{'{'}
+
+	for i, name := range labels.Names() {
+		if i > 0 {
+			buffer = append(buffer, ',')
+		}
+
+		buffer = strconv.AppendQuote(buffer, name)
+		buffer = append(buffer, '=')
+		buffer = strconv.AppendQuote(buffer, labels[name])
+	}
+
+	return string(append(buffer, '}'))
+}
+
+// Copy returns a copy of the labels.
+func (labels Labels) Copy() Labels {
+	result := make(Labels)
+
+	for name, value := range labels {
+		result[name] = value
+	}
+
+	return result
+}
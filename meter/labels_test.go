@@ -0,0 +1,123 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLabels(t *testing.T) {
+	labels := Labels{"status": "500", "method": "GET"}
+
+	if str := labels.String(); str != "{method=GET,status=500}" {
+		t.Errorf("FAIL: string mismatch '%s'", str)
+	}
+
+	if flat := labels.Flatten(); flat != "GET.500" {
+		t.Errorf("FAIL: flatten mismatch '%s'", flat)
+	}
+}
+
+func TestLabels_Multi(t *testing.T) {
+	var counter MultiCounter
+	counter.Hit("a")
+	counter.HitLabels(Labels{"status": "500"})
+	counter.CountLabels(Labels{"status": "500"}, 2)
+
+	values := counter.ReadSamples(1 * time.Second)
+	if len(values) != 2 {
+		t.Fatalf("FAIL: unexpected values %v", values)
+	}
+
+	for _, value := range values {
+		if value.Labels == nil {
+			if value.Key != "a" || value.Value != 1 {
+				t.Errorf("FAIL: unexpected value %v", value)
+			}
+		} else if value.Key != "" || value.Labels["status"] != "500" || value.Value != 3 {
+			t.Errorf("FAIL: unexpected labeled value %v", value)
+		}
+	}
+
+	var dist MultiHistogram
+	dist.RecordLabels(Labels{"route": "x"}, 1)
+
+	CheckValues(t, "histogram", dist.ReadMeter(1*time.Second), map[string]float64{
+		"x.count": 1, "x.min": 1, "x.max": 1, "x.avg": 1,
+		"x.p50": 1, "x.p90": 1, "x.p99": 1,
+	})
+}
+
+func TestLabels_Key(t *testing.T) {
+	a, b := Labels{"a": "1,b=2"}, Labels{"a": "1", "b": "2"}
+
+	if a.String() != b.String() {
+		t.Errorf("FAIL: expected ambiguous strings '%s' != '%s'", a, b)
+	}
+
+	if a.key() == b.key() {
+		t.Errorf("FAIL: key collision '%s'", a.key())
+	}
+
+	var counter MultiCounter
+	counter.HitLabels(a)
+	counter.CountLabels(b, 2)
+
+	values := counter.ReadSamples(1 * time.Second)
+	if len(values) != 2 {
+		t.Fatalf("FAIL: labels merged %v", values)
+	}
+
+	for _, value := range values {
+		exp := 1.0
+		if len(value.Labels) == 2 {
+			exp = 2
+		}
+
+		if value.Value != exp {
+			t.Errorf("FAIL: unexpected value %v", value)
+		}
+	}
+}
+
+func TestLabels_Poller(t *testing.T) {
+	var multi MultiGauge
+	multi.Change("a", 1)
+	multi.ChangeLabels(Labels{"host": "h0"}, 2)
+
+	flat := &TestHandler{T: t}
+	labeled := make(chan []Sample, 1)
+
+	poller := &Poller{
+		Meters: map[string]Meter{"m": &multi},
+		Handlers: []Handler{
+			flat,
+			sampleHandlerFunc(func(samples []Sample) { labeled <- samples }),
+		},
+	}
+	poller.poll(1 * time.Second)
+	poller.Stop(context.Background())
+
+	flat.Expect("flat", map[string]float64{"m.a": 1, "m.h0": 2})
+
+	for _, value := range <-labeled {
+		if value.Labels == nil && (value.Key != "m.a" || value.Value != 1) {
+			t.Errorf("FAIL: unexpected value %v", value)
+
+		} else if value.Labels != nil && (value.Key != "m" || value.Labels["host"] != "h0") {
+			t.Errorf("FAIL: unexpected labeled value %v", value)
+		}
+	}
+}
+
+type sampleHandlerFunc func([]Sample)
+
+func (fn sampleHandlerFunc) HandleMeters(values map[string]float64) {
+	fn(newSamples(values, SystemClock))
+}
+
+func (fn sampleHandlerFunc) HandleSamples(samples []Sample) {
+	fn(samples)
+}
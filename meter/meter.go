@@ -13,6 +13,24 @@ type Meter interface {
 	ReadMeter(time.Duration) map[string]float64
 }
 
+// SampleMeter is implemented by meters which can provide metadata along with
+// their values. ReadSamples is called instead of ReadMeter when polling and
+// the keys of the returned samples are relative to the key of the meter. The
+// poller is responsible for setting the timestamp and interval of the samples.
+type SampleMeter interface {
+	Meter
+	ReadSamples(time.Duration) []Sample
+}
+
+// readSamples reads the given meter as a set of samples and adapts the values
+// of meters which don't implement the SampleMeter interface.
+func readSamples(meter Meter, delta time.Duration) []Sample {
+	if sampler, ok := meter.(SampleMeter); ok {
+		return sampler.ReadSamples(delta)
+	}
+	return toSamples(meter.ReadMeter(delta), KindUntyped, "", "")
+}
+
 // Join concatenates the given items with a '.' character where necessary.
 func Join(items ...string) string {
 	result := ""
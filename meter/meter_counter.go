@@ -9,7 +9,19 @@ import (
 
 // Counter counts the number of occurence of an event. Is also completely
 // go-routine safe.
-type Counter struct{ value uint64 }
+type Counter struct {
+
+	// Must be first to guarantee 64-bit alignment for atomic operations.
+	value uint64
+
+	// Unit is the optional unit of the recorded values which is reported
+	// along with the values. Should not be modified after construction.
+	Unit string
+
+	// Help is an optional description of the counter which is reported along
+	// with the values. Should not be modified after construction.
+	Help string
+}
 
 // Hit adds 1 to the counter.
 func (counter *Counter) Hit() {
@@ -34,6 +46,11 @@ func (counter *Counter) ReadMeter(delta time.Duration) map[string]float64 {
 	return result
 }
 
+// ReadSamples is similar to ReadMeter but reports the value as a sample.
+func (counter *Counter) ReadSamples(delta time.Duration) []Sample {
+	return toSamples(counter.ReadMeter(delta), KindCounter, counter.Unit, counter.Help)
+}
+
 // GetCounter returns the counter registered with the given key or creates a new
 // one and registers it.
 func GetCounter(prefix string) *Counter {
@@ -0,0 +1,82 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// CumulativeCounter counts the number of occurence of an event since its
+// creation. Unlike Counter, reading the meter doesn't reset its value which
+// makes it suitable for pull-based systems that expect monotonic totals and
+// ensures that a missed poll doesn't lose any counts. Is also completely
+// go-routine safe.
+//
+// ReadMeter reports both the running total under the empty key and the per
+// second rate since the last call to ReadMeter under the rate key.
+type CumulativeCounter struct {
+
+	// Must be first to guarantee 64-bit alignment for atomic operations.
+	total uint64
+	last  uint64
+
+	// Unit is the optional unit of the recorded values which is reported
+	// along with the values. Should not be modified after construction.
+	Unit string
+
+	// Help is an optional description of the counter which is reported along
+	// with the values. Should not be modified after construction.
+	Help string
+}
+
+// Hit adds 1 to the counter.
+func (counter *CumulativeCounter) Hit() {
+	atomic.AddUint64(&counter.total, 1)
+}
+
+// Count adds the given value to the counter.
+func (counter *CumulativeCounter) Count(count uint64) {
+	atomic.AddUint64(&counter.total, count)
+}
+
+// Total returns the number of events counted since the creation of the
+// counter.
+func (counter *CumulativeCounter) Total() uint64 {
+	return atomic.LoadUint64(&counter.total)
+}
+
+// ReadMeter returns the running total of the counter along with the per second
+// rate of events counted since the last call to ReadMeter. The rate is
+// normalized using the given delta.
+func (counter *CumulativeCounter) ReadMeter(delta time.Duration) map[string]float64 {
+	total := atomic.LoadUint64(&counter.total)
+	last := atomic.SwapUint64(&counter.last, total)
+
+	rate := 0.0
+	if total > last {
+		rate = float64(total-last) * (float64(time.Second) / float64(delta))
+	}
+
+	return map[string]float64{"": float64(total), "rate": rate}
+}
+
+// ReadSamples is similar to ReadMeter but reports the values as samples where
+// the total is distinguished from the rate.
+func (counter *CumulativeCounter) ReadSamples(delta time.Duration) []Sample {
+	samples := toSamples(counter.ReadMeter(delta), KindCounter, counter.Unit, counter.Help)
+
+	for i := range samples {
+		if samples[i].Key == "" {
+			samples[i].Kind = KindTotal
+		}
+	}
+
+	return samples
+}
+
+// GetCumulativeCounter returns the cumulative counter registered with the given
+// key or creates a new one and registers it.
+func GetCumulativeCounter(prefix string) *CumulativeCounter {
+	return GetOrAdd(prefix, new(CumulativeCounter)).(*CumulativeCounter)
+}
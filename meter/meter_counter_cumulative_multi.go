@@ -0,0 +1,162 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// MultiCumulativeCounter associates CumulativeCounter objects to keys which can
+// be selected when recording. Is completely go-routine safe.
+type MultiCumulativeCounter struct {
+
+	// Unit is used to initialize the Unit member of the underlying
+	// CumulativeCounter objects.
+	Unit string
+
+	// Help is used to initialize the Help member of the underlying
+	// CumulativeCounter objects.
+	Help string
+
+	counters unsafe.Pointer
+	labels   unsafe.Pointer
+	mutex    sync.Mutex
+}
+
+// Hit calls Hit on the counter associated with the given key. New Keys are
+// lazily created as required.
+func (multi *MultiCumulativeCounter) Hit(key string) {
+	multi.get(key, nil).Hit()
+}
+
+// Count calls Count on the counter associated with the given key. New Keys are
+// lazily created as required.
+func (multi *MultiCumulativeCounter) Count(key string, count uint64) {
+	multi.get(key, nil).Count(count)
+}
+
+// With returns the counter associated with the given labels which can be kept
+// and reused to avoid building the key of the labels on every call to
+// HitLabels. New labels are lazily created as required.
+func (multi *MultiCumulativeCounter) With(labels Labels) *CumulativeCounter {
+	return multi.get(labels.key(), labels)
+}
+
+// HitLabels calls Hit on the counter associated with the given labels. New
+// labels are lazily created as required.
+func (multi *MultiCumulativeCounter) HitLabels(labels Labels) {
+	multi.get(labels.key(), labels).Hit()
+}
+
+// CountLabels calls Count on the counter associated with the given labels. New
+// labels are lazily created as required.
+func (multi *MultiCumulativeCounter) CountLabels(labels Labels, count uint64) {
+	multi.get(labels.key(), labels).Count(count)
+}
+
+// ReadMeter calls ReadMeter on all underlying counters where all the keys are
+// prefixed by the key name used in the calls to Record.
+func (multi *MultiCumulativeCounter) ReadMeter(delta time.Duration) map[string]float64 {
+	return FlattenSamples(multi.ReadSamples(delta))
+}
+
+// ReadSamples is similar to ReadMeter but reports the values as samples which
+// keep the labels of the counters created via the Labels variants of the
+// recording functions.
+func (multi *MultiCumulativeCounter) ReadSamples(delta time.Duration) []Sample {
+	var result []Sample
+
+	old := multi.load()
+	if old == nil {
+		return result
+	}
+
+	labels := multi.loadLabels()
+
+	for prefix, counter := range *old {
+		for _, sample := range counter.ReadSamples(delta) {
+			if labels != nil && (*labels)[prefix] != nil {
+				sample.Labels = (*labels)[prefix]
+				sample.suffixLen = len(sample.Key)
+			} else {
+				sample.Key = Join(prefix, sample.Key)
+			}
+			result = append(result, sample)
+		}
+	}
+
+	return result
+}
+
+func (multi *MultiCumulativeCounter) get(key string, labels Labels) *CumulativeCounter {
+	if counters := multi.load(); counters != nil {
+		if counter, ok := (*counters)[key]; ok {
+			return counter
+		}
+	}
+
+	multi.mutex.Lock()
+	defer multi.mutex.Unlock()
+
+	oldCounters := multi.load()
+	if oldCounters != nil {
+		if counter, ok := (*oldCounters)[key]; ok {
+			return counter
+		}
+	}
+
+	if labels != nil {
+		newLabels := new(map[string]Labels)
+		*newLabels = make(map[string]Labels)
+
+		if oldLabels := multi.loadLabels(); oldLabels != nil {
+			for key, labels := range *oldLabels {
+				(*newLabels)[key] = labels
+			}
+		}
+
+		// Labels must be visible before the counter that uses them.
+		(*newLabels)[key] = labels.Copy()
+		multi.storeLabels(newLabels)
+	}
+
+	newCounters := new(map[string]*CumulativeCounter)
+	*newCounters = make(map[string]*CumulativeCounter)
+
+	if oldCounters != nil {
+		for key, counter := range *oldCounters {
+			(*newCounters)[key] = counter
+		}
+	}
+
+	counter := &CumulativeCounter{Unit: multi.Unit, Help: multi.Help}
+	(*newCounters)[key] = counter
+	multi.store(newCounters)
+
+	return counter
+}
+
+func (multi *MultiCumulativeCounter) load() *map[string]*CumulativeCounter {
+	return (*map[string]*CumulativeCounter)(atomic.LoadPointer(&multi.counters))
+}
+
+func (multi *MultiCumulativeCounter) store(counters *map[string]*CumulativeCounter) {
+	atomic.StorePointer(&multi.counters, unsafe.Pointer(counters))
+}
+
+func (multi *MultiCumulativeCounter) loadLabels() *map[string]Labels {
+	return (*map[string]Labels)(atomic.LoadPointer(&multi.labels))
+}
+
+func (multi *MultiCumulativeCounter) storeLabels(labels *map[string]Labels) {
+	atomic.StorePointer(&multi.labels, unsafe.Pointer(labels))
+}
+
+// GetMultiCumulativeCounter returns the cumulative counter registered with the
+// given key or creates a new one and registers it.
+func GetMultiCumulativeCounter(prefix string) *MultiCumulativeCounter {
+	return GetOrAdd(prefix, new(MultiCumulativeCounter)).(*MultiCumulativeCounter)
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCumulativeCounter(t *testing.T) {
+	var counter CumulativeCounter
+
+	CheckValues(t, "empty", counter.ReadMeter(1*time.Second), map[string]float64{"": 0, "rate": 0})
+
+	counter.Count(100)
+	CheckValues(t, "first", counter.ReadMeter(2*time.Second), map[string]float64{"": 100, "rate": 50})
+
+	counter.Hit()
+	counter.Count(9)
+	CheckValues(t, "second", counter.ReadMeter(500*time.Millisecond), map[string]float64{"": 110, "rate": 20})
+
+	CheckValues(t, "idle", counter.ReadMeter(1*time.Second), map[string]float64{"": 110, "rate": 0})
+
+	if total := counter.Total(); total != 110 {
+		t.Errorf("FAIL: total=%d != 110", total)
+	}
+
+	for _, sample := range counter.ReadSamples(1 * time.Second) {
+		if exp := map[string]Kind{"": KindTotal, "rate": KindCounter}[sample.Key]; sample.Kind != exp {
+			t.Errorf("FAIL: kind mismatch for '%s' -> %s != %s", sample.Key, sample.Kind, exp)
+		}
+	}
+}
+
+func TestCumulativeCounter_Multi(t *testing.T) {
+	var multi MultiCumulativeCounter
+
+	multi.Hit("a")
+	multi.CountLabels(Labels{"status": "500"}, 2)
+	multi.ReadMeter(1 * time.Second)
+
+	multi.Hit("a")
+
+	CheckValues(t, "multi", multi.ReadMeter(1*time.Second), map[string]float64{
+		"a": 2, "a.rate": 1,
+		"500": 2, "500.rate": 0,
+	})
+}
+
+func TestCumulativeCounter_Prometheus(t *testing.T) {
+	var obj struct{ Requests *CumulativeCounter }
+
+	Load(&obj, "test.cumulative")
+	defer Unload(&obj, "test.cumulative")
+
+	obj.Requests.Count(3)
+
+	handler := &PrometheusHandler{}
+	poller := &Poller{
+		Meters:   map[string]Meter{"requests": obj.Requests},
+		Handlers: []Handler{handler},
+	}
+	poller.poll(1 * time.Second)
+	poller.Stop(context.Background())
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	exp := "# TYPE requests counter\n" +
+		"requests 3\n" +
+		"# TYPE requests_rate gauge\n" +
+		"requests_rate 3\n"
+
+	if body := recorder.Body.String(); body != exp {
+		t.Errorf("FAIL: body mismatch\n%s\n!=\n%s", body, exp)
+	}
+}
@@ -12,42 +12,86 @@ import (
 // MultiCounter associates Counter objects to keys which can be selected when
 // recording. Is completely go-routine safe.
 type MultiCounter struct {
+
+	// Unit is used to initialize the Unit member of the underlying Counter
+	// objects.
+	Unit string
+
+	// Help is used to initialize the Help member of the underlying Counter
+	// objects.
+	Help string
+
 	counters unsafe.Pointer
+	labels   unsafe.Pointer
 	mutex    sync.Mutex
 }
 
 // Hit calls Hit on the counter associated with the given key. New Keys are
 // lazily created as required.
 func (multi *MultiCounter) Hit(key string) {
-	multi.get(key).Hit()
+	multi.get(key, nil).Hit()
 }
 
 // Count calls Count on the counter associated with the given key. New Keys are
 // lazily created as required.
 func (multi *MultiCounter) Count(key string, count uint64) {
-	multi.get(key).Count(count)
+	multi.get(key, nil).Count(count)
+}
+
+// With returns the counter associated with the given labels which can be kept
+// and reused to avoid building the key of the labels on every call to
+// HitLabels. New labels are lazily created as required.
+func (multi *MultiCounter) With(labels Labels) *Counter {
+	return multi.get(labels.key(), labels)
+}
+
+// HitLabels calls Hit on the counter associated with the given labels. New
+// labels are lazily created as required.
+func (multi *MultiCounter) HitLabels(labels Labels) {
+	multi.get(labels.key(), labels).Hit()
+}
+
+// CountLabels calls Count on the counter associated with the given labels. New
+// labels are lazily created as required.
+func (multi *MultiCounter) CountLabels(labels Labels, count uint64) {
+	multi.get(labels.key(), labels).Count(count)
 }
 
 // ReadMeter calls ReadMeter on all underlying counters where all the keys are
 // prefixed by the key name used in the calls to Record.
 func (multi *MultiCounter) ReadMeter(delta time.Duration) map[string]float64 {
-	result := make(map[string]float64)
+	return FlattenSamples(multi.ReadSamples(delta))
+}
+
+// ReadSamples is similar to ReadMeter but reports the values as samples which
+// keep the labels of the counters created via the Labels variants of the
+// recording functions.
+func (multi *MultiCounter) ReadSamples(delta time.Duration) []Sample {
+	var result []Sample
 
 	old := multi.load()
 	if old == nil {
 		return result
 	}
 
+	labels := multi.loadLabels()
+
 	for prefix, counter := range *old {
-		for suffix, value := range counter.ReadMeter(delta) {
-			result[Join(prefix, suffix)] = value
+		for _, sample := range counter.ReadSamples(delta) {
+			if labels != nil && (*labels)[prefix] != nil {
+				sample.Labels = (*labels)[prefix]
+				sample.suffixLen = len(sample.Key)
+			} else {
+				sample.Key = Join(prefix, sample.Key)
+			}
+			result = append(result, sample)
 		}
 	}
 
 	return result
 }
 
-func (multi *MultiCounter) get(key string) *Counter {
+func (multi *MultiCounter) get(key string, labels Labels) *Counter {
 	if counters := multi.load(); counters != nil {
 		if counter, ok := (*counters)[key]; ok {
 			return counter
@@ -64,6 +108,21 @@ func (multi *MultiCounter) get(key string) *Counter {
 		}
 	}
 
+	if labels != nil {
+		newLabels := new(map[string]Labels)
+		*newLabels = make(map[string]Labels)
+
+		if oldLabels := multi.loadLabels(); oldLabels != nil {
+			for key, labels := range *oldLabels {
+				(*newLabels)[key] = labels
+			}
+		}
+
+		// Labels must be visible before the counter that uses them.
+		(*newLabels)[key] = labels.Copy()
+		multi.storeLabels(newLabels)
+	}
+
 	newCounters := new(map[string]*Counter)
 	*newCounters = make(map[string]*Counter)
 
@@ -73,7 +132,7 @@ func (multi *MultiCounter) get(key string) *Counter {
 		}
 	}
 
-	counter := new(Counter)
+	counter := &Counter{Unit: multi.Unit, Help: multi.Help}
 	(*newCounters)[key] = counter
 	multi.store(newCounters)
 
@@ -88,6 +147,14 @@ func (multi *MultiCounter) store(counters *map[string]*Counter) {
 	atomic.StorePointer(&multi.counters, unsafe.Pointer(counters))
 }
 
+func (multi *MultiCounter) loadLabels() *map[string]Labels {
+	return (*map[string]Labels)(atomic.LoadPointer(&multi.labels))
+}
+
+func (multi *MultiCounter) storeLabels(labels *map[string]Labels) {
+	atomic.StorePointer(&multi.labels, unsafe.Pointer(labels))
+}
+
 // GetMultiCounter returns the counter registered with the given key or creates
 // a new one and registers it.
 func GetMultiCounter(prefix string) *MultiCounter {
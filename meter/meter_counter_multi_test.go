@@ -91,6 +91,24 @@ func ReadValuesInto(t *testing.T, multi *MultiCounter, values map[string]float64
 	}
 }
 
+func TestCounterMulti_With(t *testing.T) {
+	var multi MultiCounter
+
+	counter := multi.With(Labels{"status": "500"})
+	if multi.With(Labels{"status": "500"}) != counter {
+		t.Errorf("FAIL: expected the same counter")
+	}
+
+	counter.Hit()
+	multi.HitLabels(Labels{"status": "500"})
+
+	CheckValues(t, "with", multi.ReadMeter(1*time.Second), map[string]float64{"500": 2})
+
+	if allocs := testing.AllocsPerRun(100, func() { counter.Hit() }); allocs != 0 {
+		t.Errorf("FAIL: %f allocations per hit", allocs)
+	}
+}
+
 func BenchmarkMultiCounter_ControlSeq(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		strconv.Itoa(i)
@@ -112,6 +130,30 @@ func BenchmarkMultiCounter_10KeySeq(b *testing.B)   { BenchMultiCounterSeq(b, 10
 func BenchmarkMultiCounter_100KeySeq(b *testing.B)  { BenchMultiCounterSeq(b, 100) }
 func BenchmarkMultiCounter_1000KeySeq(b *testing.B) { BenchMultiCounterSeq(b, 1000) }
 
+func BenchmarkMultiCounter_LabelsSeq(b *testing.B) {
+	var multi MultiCounter
+	labels := Labels{"method": "GET", "status": "500"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		multi.HitLabels(labels)
+	}
+}
+
+func BenchmarkMultiCounter_WithSeq(b *testing.B) {
+	var multi MultiCounter
+	counter := multi.With(Labels{"method": "GET", "status": "500"})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		counter.Hit()
+	}
+}
+
 func BenchmarkMultiCounter_ControlPara(b *testing.B) {
 	b.RunParallel(func(pb *testing.PB) {
 		for i := 0; pb.Next(); i++ {
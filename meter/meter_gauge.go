@@ -16,7 +16,16 @@ type Gauge struct {
 	// written after construction.
 	Value float64
 
+	// Unit is the optional unit of the recorded values which is reported
+	// along with the values. Should not be modified after construction.
+	Unit string
+
+	// Help is an optional description of the gauge which is reported along
+	// with the values. Should not be modified after construction.
+	Help string
+
 	mutex sync.Mutex
+	clock clockRef
 }
 
 // Change changes the recorded value.
@@ -35,7 +44,12 @@ func (gauge *Gauge) ChangeDuration(duration time.Duration) {
 
 // ChangeSince records a duration elapsed since the given time.
 func (gauge *Gauge) ChangeSince(t0 time.Time) {
-	gauge.ChangeDuration(time.Since(t0))
+	gauge.ChangeDuration(gauge.clock.Get().Now().Sub(t0))
+}
+
+// SetClock sets the clock used by ChangeSince.
+func (gauge *Gauge) SetClock(clock Clock) {
+	gauge.clock.Set(clock)
 }
 
 // ReadMeter returns the currently set value if not equal to 0.
@@ -53,6 +67,11 @@ func (gauge *Gauge) ReadMeter(_ time.Duration) map[string]float64 {
 	return result
 }
 
+// ReadSamples is similar to ReadMeter but reports the value as a sample.
+func (gauge *Gauge) ReadSamples(delta time.Duration) []Sample {
+	return toSamples(gauge.ReadMeter(delta), KindGauge, gauge.Unit, gauge.Help)
+}
+
 // GetGauge returns the gauge registered with the given key or creates a new one
 // and registers.
 func GetGauge(prefix string) *Gauge {
@@ -0,0 +1,53 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"time"
+)
+
+// GaugeFunc is a gauge whose value is obtained by calling the function when
+// the meter is polled. This is useful to report values that are cheaper to
+// read when needed than to keep updated (eg. queue depths, pool sizes, etc.).
+// The function must be go-routine safe.
+type GaugeFunc func() float64
+
+// ReadMeter calls the function and returns its value.
+func (fn GaugeFunc) ReadMeter(_ time.Duration) map[string]float64 {
+	return map[string]float64{"": fn()}
+}
+
+// ReadSamples is similar to ReadMeter but reports the value as a sample.
+func (fn GaugeFunc) ReadSamples(delta time.Duration) []Sample {
+	return toSamples(fn.ReadMeter(delta), KindGauge, "", "")
+}
+
+// MultiGaugeFunc is similar to GaugeFunc but the function returns multiple
+// values associated with keys. The returned map must not be modified after
+// being returned.
+type MultiGaugeFunc func() map[string]float64
+
+// ReadMeter calls the function and returns its values.
+func (fn MultiGaugeFunc) ReadMeter(_ time.Duration) map[string]float64 {
+	if values := fn(); values != nil {
+		return values
+	}
+	return make(map[string]float64)
+}
+
+// ReadSamples is similar to ReadMeter but reports the values as samples.
+func (fn MultiGaugeFunc) ReadSamples(delta time.Duration) []Sample {
+	return toSamples(fn.ReadMeter(delta), KindGauge, "", "")
+}
+
+// GetGaugeFunc returns the gauge registered with the given key or registers the
+// given function if no meters are registered for the key.
+func GetGaugeFunc(prefix string, fn func() float64) GaugeFunc {
+	return GetOrAdd(prefix, GaugeFunc(fn)).(GaugeFunc)
+}
+
+// GetMultiGaugeFunc returns the gauge registered with the given key or
+// registers the given function if no meters are registered for the key.
+func GetMultiGaugeFunc(prefix string, fn func() map[string]float64) MultiGaugeFunc {
+	return GetOrAdd(prefix, MultiGaugeFunc(fn)).(MultiGaugeFunc)
+}
@@ -12,47 +12,96 @@ import (
 // MultiGauge associates Gauge objects to keys which can be selected when
 // recording. Is completely go-routine safe.
 type MultiGauge struct {
+
+	// Unit is used to initialize the Unit member of the underlying Gauge
+	// objects.
+	Unit string
+
+	// Help is used to initialize the Help member of the underlying Gauge
+	// objects.
+	Help string
+
 	gauges unsafe.Pointer
+	labels unsafe.Pointer
 	mutex  sync.Mutex
+	clock  clockRef
 }
 
 // Change records the given value with the gauge associated with the given
 // key. New Keys are lazily created as required.
 func (multi *MultiGauge) Change(key string, value float64) {
-	multi.get(key).Change(value)
+	multi.get(key, nil).Change(value)
 }
 
 // ChangeDuration similar to Change but with a time.Duration value.
 func (multi *MultiGauge) ChangeDuration(key string, duration time.Duration) {
-	multi.get(key).ChangeDuration(duration)
+	multi.get(key, nil).ChangeDuration(duration)
 }
 
 // ChangeSince records a duration elapsed since the given time with the given
 // key.
 func (multi *MultiGauge) ChangeSince(key string, t0 time.Time) {
-	multi.get(key).ChangeSince(t0)
+	multi.get(key, nil).ChangeDuration(multi.clock.Get().Now().Sub(t0))
+}
+
+// SetClock sets the clock used by ChangeSince.
+func (multi *MultiGauge) SetClock(clock Clock) {
+	multi.clock.Set(clock)
+}
+
+// With returns the gauge associated with the given labels which can be kept
+// and reused to avoid building the key of the labels on every call to
+// ChangeLabels. New labels are lazily created as required.
+func (multi *MultiGauge) With(labels Labels) *Gauge {
+	return multi.get(labels.key(), labels)
+}
+
+// ChangeLabels records the given value with the gauge associated with the given
+// labels. New labels are lazily created as required.
+func (multi *MultiGauge) ChangeLabels(labels Labels, value float64) {
+	multi.get(labels.key(), labels).Change(value)
+}
+
+// ChangeDurationLabels similar to ChangeLabels but with a time.Duration value.
+func (multi *MultiGauge) ChangeDurationLabels(labels Labels, duration time.Duration) {
+	multi.get(labels.key(), labels).ChangeDuration(duration)
 }
 
 // ReadMeter calls ReadMeter on all underlying gauges where all the keys are
 // prefixed by the key name used in the calls to Record.
 func (multi *MultiGauge) ReadMeter(delta time.Duration) map[string]float64 {
-	result := make(map[string]float64)
+	return FlattenSamples(multi.ReadSamples(delta))
+}
+
+// ReadSamples is similar to ReadMeter but reports the values as samples which
+// keep the labels of the gauges created via the Labels variants of the
+// recording functions.
+func (multi *MultiGauge) ReadSamples(delta time.Duration) []Sample {
+	var result []Sample
 
 	old := multi.load()
 	if old == nil {
 		return result
 	}
 
+	labels := multi.loadLabels()
+
 	for prefix, gauge := range *old {
-		for suffix, value := range gauge.ReadMeter(delta) {
-			result[Join(prefix, suffix)] = value
+		for _, sample := range gauge.ReadSamples(delta) {
+			if labels != nil && (*labels)[prefix] != nil {
+				sample.Labels = (*labels)[prefix]
+				sample.suffixLen = len(sample.Key)
+			} else {
+				sample.Key = Join(prefix, sample.Key)
+			}
+			result = append(result, sample)
 		}
 	}
 
 	return result
 }
 
-func (multi *MultiGauge) get(key string) *Gauge {
+func (multi *MultiGauge) get(key string, labels Labels) *Gauge {
 	if gauges := multi.load(); gauges != nil {
 		if gauge, ok := (*gauges)[key]; ok {
 			return gauge
@@ -69,6 +118,21 @@ func (multi *MultiGauge) get(key string) *Gauge {
 		}
 	}
 
+	if labels != nil {
+		newLabels := new(map[string]Labels)
+		*newLabels = make(map[string]Labels)
+
+		if oldLabels := multi.loadLabels(); oldLabels != nil {
+			for key, labels := range *oldLabels {
+				(*newLabels)[key] = labels
+			}
+		}
+
+		// Labels must be visible before the gauge that uses them.
+		(*newLabels)[key] = labels.Copy()
+		multi.storeLabels(newLabels)
+	}
+
 	newGauges := new(map[string]*Gauge)
 	*newGauges = make(map[string]*Gauge)
 
@@ -78,7 +142,7 @@ func (multi *MultiGauge) get(key string) *Gauge {
 		}
 	}
 
-	gauge := new(Gauge)
+	gauge := &Gauge{Unit: multi.Unit, Help: multi.Help}
 	(*newGauges)[key] = gauge
 	multi.store(newGauges)
 
@@ -93,6 +157,14 @@ func (multi *MultiGauge) store(gauges *map[string]*Gauge) {
 	atomic.StorePointer(&multi.gauges, unsafe.Pointer(gauges))
 }
 
+func (multi *MultiGauge) loadLabels() *map[string]Labels {
+	return (*map[string]Labels)(atomic.LoadPointer(&multi.labels))
+}
+
+func (multi *MultiGauge) storeLabels(labels *map[string]Labels) {
+	atomic.StorePointer(&multi.labels, unsafe.Pointer(labels))
+}
+
 // GetMultiGauge returns the gauge registered with the given key or creates a
 // new one and registers it.
 func GetMultiGauge(prefix string) *MultiGauge {
@@ -26,3 +26,52 @@ func CheckGauge(t *testing.T, gauge *Gauge, exp float64) {
 		t.Errorf("FAIL: value=%f != %f", value, exp)
 	}
 }
+
+func TestGaugeFunc(t *testing.T) {
+	value := 1.0
+	gauge := GaugeFunc(func() float64 { return value })
+
+	CheckValues(t, "first", gauge.ReadMeter(0), map[string]float64{"": 1})
+
+	value = 2
+	CheckValues(t, "second", gauge.ReadMeter(0), map[string]float64{"": 2})
+
+	multi := MultiGaugeFunc(func() map[string]float64 { return map[string]float64{"a": value} })
+	CheckValues(t, "multi", multi.ReadMeter(0), map[string]float64{"a": 2})
+
+	empty := MultiGaugeFunc(func() map[string]float64 { return nil })
+	CheckValues(t, "empty", empty.ReadMeter(0), map[string]float64{})
+}
+
+func TestGaugeFunc_Load(t *testing.T) {
+	var obj struct {
+		Depth  func() float64
+		Sizes  MultiGaugeFunc
+		Unused func() float64
+	}
+
+	obj.Depth = func() float64 { return 10 }
+	obj.Sizes = func() map[string]float64 { return map[string]float64{"a": 1, "b": 2} }
+
+	Load(&obj, "test.gaugefunc")
+
+	CheckValues(t, "depth", Get("test.gaugefunc.Depth").ReadMeter(0), map[string]float64{"": 10})
+	CheckValues(t, "sizes", Get("test.gaugefunc.Sizes").ReadMeter(0), map[string]float64{"a": 1, "b": 2})
+
+	if Get("test.gaugefunc.Unused") != nil {
+		t.Errorf("FAIL: nil function was registered")
+	}
+
+	Unload(&obj, "test.gaugefunc")
+
+	if Get("test.gaugefunc.Depth") != nil {
+		t.Errorf("FAIL: function was not unregistered")
+	}
+
+	fn := GetGaugeFunc("test.gaugefunc.get", func() float64 { return 3 })
+	defer Remove("test.gaugefunc.get")
+
+	if other := GetGaugeFunc("test.gaugefunc.get", func() float64 { return 4 }); other() != fn() {
+		t.Errorf("FAIL: registered function was replaced")
+	}
+}
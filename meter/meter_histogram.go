@@ -6,6 +6,8 @@ import (
 	"math"
 	"math/rand"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,6 +15,34 @@ import (
 // DefaultHistogramSize is used if Size is not set in Histogram.
 const DefaultHistogramSize = 1000
 
+// Stats is a set of statistics computed by a histogram over all of its recorded
+// values.
+type Stats int
+
+const (
+	// StatCount reports the number of recorded values under the count key.
+	StatCount Stats = 1 << iota
+
+	// StatMin reports the smallest recorded value under the min key.
+	StatMin
+
+	// StatMax reports the largest recorded value under the max key.
+	StatMax
+
+	// StatAvg reports the mean of the recorded values under the avg key.
+	StatAvg
+
+	// StatSum reports the sum of the recorded values under the sum key.
+	StatSum
+
+	// StatStdDev reports the population standard deviation of the recorded
+	// values under the stddev key.
+	StatStdDev
+)
+
+// DefaultStats is used if Stats is not set in Histogram.
+const DefaultStats = StatCount | StatMin | StatMax | StatAvg
+
 // Histogram aggregates metrics over a histogram of values.
 //
 // Record will add up to a maximum of Size elements after which new elements
@@ -20,8 +50,9 @@ const DefaultHistogramSize = 1000
 // elements recorded. This schemes ensures that a histogram has a constant
 // memory footprint and doesn't need to allocate for calls to Record.
 //
-// ReadMeter will compute percentiles over the sampled histogram and the min
-// and max value seen over the entire histogram.
+// ReadMeter will compute the configured quantiles over the sampled histogram
+// and the configured statistics over the entire histogram. Quantiles are
+// interpolated linearly between the two closest ranks of the sampled values.
 //
 // Histogram is completely go-routine safe.
 type Histogram struct {
@@ -33,8 +64,28 @@ type Histogram struct {
 	// SamplingSeed is the initial seed for the RNG used during sampling.
 	SamplingSeed int64
 
+	// Quantiles are the quantiles between 0 and 1 that will be reported. Each
+	// quantile is reported using a percentile suffix such that 0.99 becomes
+	// p99 and 0.999 becomes p999. Defaults to DefaultQuantiles. Should not be
+	// modified after construction.
+	Quantiles []float64
+
+	// Stats are the statistics that will be reported along with the
+	// quantiles. Defaults to DefaultStats. Should not be modified after
+	// construction.
+	Stats Stats
+
+	// Unit is the optional unit of the recorded values which is reported
+	// along with the values. Should not be modified after construction.
+	Unit string
+
+	// Help is an optional description of the histogram which is reported along
+	// with the values. Should not be modified after construction.
+	Help string
+
 	mutex sync.Mutex
 	state *histogram
+	clock clockRef
 }
 
 // Record adds the given value to the histogram with a probability based on
@@ -57,12 +108,18 @@ func (dist *Histogram) RecordDuration(duration time.Duration) {
 
 // RecordSince records a duration elapsed since the given time.
 func (dist *Histogram) RecordSince(t0 time.Time) {
-	dist.RecordDuration(time.Since(t0))
+	dist.RecordDuration(dist.clock.Get().Now().Sub(t0))
 }
 
-// ReadMeter computes various statistic over the sampled histogram (50th,
-// 90th and 99th percentile) and the count, min and max over the entire
-// histogram. All recorded elements are then discarded from the histogram.
+// SetClock sets the clock used by RecordSince.
+func (dist *Histogram) SetClock(clock Clock) {
+	dist.clock.Set(clock)
+}
+
+// ReadMeter computes the configured quantiles over the sampled histogram (50th,
+// 90th and 99th percentile by default) and the configured statistics over the
+// entire histogram (count, min, max and avg by default). All recorded elements
+// are then discarded from the histogram.
 func (dist *Histogram) ReadMeter(_ time.Duration) map[string]float64 {
 	dist.mutex.Lock()
 
@@ -75,7 +132,25 @@ func (dist *Histogram) ReadMeter(_ time.Duration) map[string]float64 {
 		return make(map[string]float64)
 	}
 
-	return oldState.Read()
+	return oldState.Read(dist.getQuantiles(), dist.getStats())
+}
+
+// ReadSamples is similar to ReadMeter but reports the values as samples where
+// the percentiles are distinguished from the other statistics.
+func (dist *Histogram) ReadSamples(delta time.Duration) []Sample {
+	return histogramSamples(dist.ReadMeter(delta), dist.Unit, dist.Help)
+}
+
+func histogramSamples(values map[string]float64, unit, help string) []Sample {
+	samples := toSamples(values, KindHistogram, unit, help)
+
+	for i := range samples {
+		if _, ok := parsePercentile(samples[i].Key); ok {
+			samples[i].Kind = KindPercentile
+		}
+	}
+
+	return samples
 }
 
 func (dist *Histogram) getSize() int {
@@ -85,6 +160,20 @@ func (dist *Histogram) getSize() int {
 	return dist.Size
 }
 
+func (dist *Histogram) getQuantiles() []float64 {
+	if len(dist.Quantiles) == 0 {
+		return DefaultQuantiles
+	}
+	return dist.Quantiles
+}
+
+func (dist *Histogram) getStats() Stats {
+	if dist.Stats == 0 {
+		return DefaultStats
+	}
+	return dist.Stats
+}
+
 func (dist *Histogram) getSeed() int64 {
 	dist.SamplingSeed++
 	return dist.SamplingSeed
@@ -96,6 +185,9 @@ type histogram struct {
 	min, max float64
 	sum      float64
 
+	// mean and m2 are used to compute the variance using Welford's algorithm.
+	mean, m2 float64
+
 	rand *rand.Rand
 }
 
@@ -112,6 +204,10 @@ func (dist *histogram) Record(value float64) {
 	dist.count++
 	dist.sum += value
 
+	delta := value - dist.mean
+	dist.mean += delta / float64(dist.count)
+	dist.m2 += delta * (value - dist.mean)
+
 	if dist.count <= len(dist.items) {
 		dist.items[dist.count-1] = value
 
@@ -134,37 +230,116 @@ func (array float64Array) Len() int           { return len(array) }
 func (array float64Array) Swap(i, j int)      { array[i], array[j] = array[j], array[i] }
 func (array float64Array) Less(i, j int) bool { return array[i] < array[j] }
 
-func (dist *histogram) Read() map[string]float64 {
+// Read computes the given quantiles and statistics over the histogram. The
+// sampled items are sorted in place so the histogram should be discarded
+// afterwards.
+func (dist *histogram) Read(quantiles []float64, stats Stats) map[string]float64 {
 	if dist.count == 0 {
 		return map[string]float64{}
 	}
 
-	items := make([]float64, len(dist.items))
-	for i := 0; i < len(dist.items); i++ {
-		items[i] = dist.items[i]
+	n := dist.count
+	if dist.count > len(dist.items) {
+		n = len(dist.items)
 	}
 
-	n := dist.count
-	if dist.count > len(items) {
-		n = len(items)
+	items := dist.items[:n]
+	sort.Sort(float64Array(items))
+
+	values := make(map[string]float64, len(quantiles)+6)
+
+	for _, q := range quantiles {
+		values[percentileSuffix(q)] = quantile(items, q)
 	}
 
-	sort.Sort(float64Array(items[:n]))
+	if stats&StatCount != 0 {
+		values["count"] = float64(dist.count)
+	}
+
+	if stats&StatMin != 0 {
+		values["min"] = dist.min
+	}
+
+	if stats&StatMax != 0 {
+		values["max"] = dist.max
+	}
+
+	if stats&StatAvg != 0 {
+		values["avg"] = dist.sum / float64(dist.count)
+	}
+
+	if stats&StatSum != 0 {
+		values["sum"] = dist.sum
+	}
+
+	if stats&StatStdDev != 0 {
+		values["stddev"] = math.Sqrt(dist.m2 / float64(dist.count))
+	}
+
+	return values
+}
+
+// quantile computes the given quantile over the sorted items by linearly
+// interpolating between the two closest ranks.
+func quantile(items []float64, q float64) float64 {
+	if q <= 0 {
+		return items[0]
+	}
+
+	if q >= 1 {
+		return items[len(items)-1]
+	}
 
-	percentile := func(p int) float64 {
-		index := float32(n) / 100 * float32(p)
-		return items[int(index)]
+	rank := q * float64(len(items)-1)
+	i := int(rank)
+
+	if i+1 >= len(items) {
+		return items[i]
 	}
 
-	return map[string]float64{
-		"count": float64(dist.count),
-		"min":   dist.min,
-		"max":   dist.max,
-		"avg":   dist.sum / float64(dist.count),
-		"p50":   percentile(50),
-		"p90":   percentile(90),
-		"p99":   percentile(99),
+	return items[i] + (rank-float64(i))*(items[i+1]-items[i])
+}
+
+// parsePercentile converts a histogram percentile suffix (eg. p50 or p999) into
+// a quantile value between 0 and 1. The first two digits represent the integer
+// part of the percentile and any remaining digits are decimals.
+func parsePercentile(suffix string) (float64, bool) {
+	if len(suffix) < 2 || suffix[0] != 'p' {
+		return 0, false
 	}
+
+	digits := suffix[1:]
+
+	value, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	if len(digits) <= 2 || digits == "100" {
+		return float64(value) / 100, true
+	}
+
+	return float64(value) / math.Pow10(len(digits)), true
+}
+
+// percentileSuffix converts a quantile value between 0 and 1 into a histogram
+// percentile suffix such that 0.5 becomes p50 and 0.999 becomes p999. This is
+// the inverse of parsePercentile.
+func percentileSuffix(q float64) string {
+	if q >= 1 {
+		return "p100"
+	}
+
+	if q <= 0 {
+		return "p00"
+	}
+
+	digits := strings.TrimPrefix(strconv.FormatFloat(q, 'f', -1, 64), "0.")
+	if len(digits) < 2 {
+		digits += "0"
+	}
+
+	return "p" + digits
 }
 
 // GetHistogram returns the histogram registered with the given key or creates a
@@ -21,47 +21,103 @@ type MultiHistogram struct {
 	// Histogram objects.
 	SamplingSeed int64
 
-	dists unsafe.Pointer
-	mutex sync.Mutex
+	// Quantiles is used to initialize the Quantiles member of the underlying
+	// Histogram objects.
+	Quantiles []float64
+
+	// Stats is used to initialize the Stats member of the underlying Histogram
+	// objects.
+	Stats Stats
+
+	// Unit is used to initialize the Unit member of the underlying Histogram
+	// objects.
+	Unit string
+
+	// Help is used to initialize the Help member of the underlying Histogram
+	// objects.
+	Help string
+
+	dists  unsafe.Pointer
+	labels unsafe.Pointer
+	mutex  sync.Mutex
+	clock  clockRef
 }
 
 // Record adds the given value to the histogram associated with the given
 // key. New keys are lazily created as required.
 func (multi *MultiHistogram) Record(key string, value float64) {
-	multi.get(key).Record(value)
+	multi.get(key, nil).Record(value)
 }
 
 // RecordDuration similar to Record but with time.Duration values.
 func (multi *MultiHistogram) RecordDuration(key string, value time.Duration) {
-	multi.get(key).RecordDuration(value)
+	multi.get(key, nil).RecordDuration(value)
 }
 
 // RecordSince records a duration elapsed since the given time for the given
 // key.
 func (multi *MultiHistogram) RecordSince(key string, t0 time.Time) {
-	multi.get(key).RecordSince(t0)
+	multi.get(key, nil).RecordDuration(multi.clock.Get().Now().Sub(t0))
+}
+
+// SetClock sets the clock used by RecordSince.
+func (multi *MultiHistogram) SetClock(clock Clock) {
+	multi.clock.Set(clock)
+}
+
+// With returns the histogram associated with the given labels which can be kept
+// and reused to avoid building the key of the labels on every call to
+// RecordLabels. New labels are lazily created as required.
+func (multi *MultiHistogram) With(labels Labels) *Histogram {
+	return multi.get(labels.key(), labels)
+}
+
+// RecordLabels adds the given value to the histogram associated with the given
+// labels. New labels are lazily created as required.
+func (multi *MultiHistogram) RecordLabels(labels Labels, value float64) {
+	multi.get(labels.key(), labels).Record(value)
+}
+
+// RecordDurationLabels similar to RecordLabels but with time.Duration values.
+func (multi *MultiHistogram) RecordDurationLabels(labels Labels, value time.Duration) {
+	multi.get(labels.key(), labels).RecordDuration(value)
 }
 
 // ReadMeter calls ReadMeter on all the underlying histograms where all the
 // keys are prefixed by the key name used in the calls to Record.
 func (multi *MultiHistogram) ReadMeter(delta time.Duration) map[string]float64 {
-	result := make(map[string]float64)
+	return FlattenSamples(multi.ReadSamples(delta))
+}
+
+// ReadSamples is similar to ReadMeter but reports the values as samples which
+// keep the labels of the histograms created via the Labels variants of the
+// recording functions.
+func (multi *MultiHistogram) ReadSamples(delta time.Duration) []Sample {
+	var result []Sample
 
 	old := multi.load()
 	if old == nil {
 		return result
 	}
 
+	labels := multi.loadLabels()
+
 	for prefix, dist := range *old {
-		for suffix, value := range dist.ReadMeter(delta) {
-			result[Join(prefix, suffix)] = value
+		for _, sample := range dist.ReadSamples(delta) {
+			if labels != nil && (*labels)[prefix] != nil {
+				sample.Labels = (*labels)[prefix]
+				sample.suffixLen = len(sample.Key)
+			} else {
+				sample.Key = Join(prefix, sample.Key)
+			}
+			result = append(result, sample)
 		}
 	}
 
 	return result
 }
 
-func (multi *MultiHistogram) get(key string) *Histogram {
+func (multi *MultiHistogram) get(key string, labels Labels) *Histogram {
 	if dists := multi.load(); dists != nil {
 		if dist, ok := (*dists)[key]; ok {
 			return dist
@@ -78,6 +134,21 @@ func (multi *MultiHistogram) get(key string) *Histogram {
 		}
 	}
 
+	if labels != nil {
+		newLabels := new(map[string]Labels)
+		*newLabels = make(map[string]Labels)
+
+		if oldLabels := multi.loadLabels(); oldLabels != nil {
+			for key, labels := range *oldLabels {
+				(*newLabels)[key] = labels
+			}
+		}
+
+		// Labels must be visible before the dist that uses them.
+		(*newLabels)[key] = labels.Copy()
+		multi.storeLabels(newLabels)
+	}
+
 	newDists := new(map[string]*Histogram)
 	*newDists = make(map[string]*Histogram)
 
@@ -90,6 +161,10 @@ func (multi *MultiHistogram) get(key string) *Histogram {
 	dist := &Histogram{
 		Size:         multi.Size,
 		SamplingSeed: multi.SamplingSeed,
+		Quantiles:    multi.Quantiles,
+		Stats:        multi.Stats,
+		Unit:         multi.Unit,
+		Help:         multi.Help,
 	}
 	(*newDists)[key] = dist
 	multi.store(newDists)
@@ -105,6 +180,14 @@ func (multi *MultiHistogram) store(dists *map[string]*Histogram) {
 	atomic.StorePointer(&multi.dists, unsafe.Pointer(dists))
 }
 
+func (multi *MultiHistogram) loadLabels() *map[string]Labels {
+	return (*map[string]Labels)(atomic.LoadPointer(&multi.labels))
+}
+
+func (multi *MultiHistogram) storeLabels(labels *map[string]Labels) {
+	atomic.StorePointer(&multi.labels, unsafe.Pointer(labels))
+}
+
 // GetMultiHistogram returns the histogram registered with the given key or
 // creates a new one and registers it.
 func GetMultiHistogram(prefix string) *MultiHistogram {
@@ -4,6 +4,7 @@ package meter
 
 import (
 	"fmt"
+	"math"
 	"testing"
 	"time"
 )
@@ -73,6 +74,58 @@ func TestHistogram_Para(t *testing.T) {
 	}
 }
 
+func TestHistogram_Quantiles(t *testing.T) {
+	dist := &Histogram{
+		Quantiles: []float64{0.5, 0.95, 0.999},
+		Stats:     StatCount | StatSum | StatStdDev,
+	}
+
+	for i := 0; i < 100; i++ {
+		dist.Record(float64(i))
+	}
+
+	values := dist.ReadMeter(1 * time.Second)
+
+	stddev := values["stddev"]
+	if exp := math.Sqrt(9999.0 / 12); math.Abs(stddev-exp) > 1e-9 {
+		t.Errorf("FAIL: stddev=%f != %f", stddev, exp)
+	}
+	delete(values, "stddev")
+
+	CheckValues(t, "quantiles", values, map[string]float64{
+		"count": 100,
+		"sum":   4950,
+		"p50":   49.5,
+		"p95":   94.05,
+		"p999":  98.901,
+	})
+}
+
+func TestHistogram_Interpolation(t *testing.T) {
+	items := []float64{1, 2, 4, 8}
+
+	for q, exp := range map[float64]float64{0: 1, 0.5: 3, 0.9: 6.8, 1: 8} {
+		if value := quantile(items, q); math.Abs(value-exp) > 1e-9 {
+			t.Errorf("FAIL: q%g=%f != %f", q, value, exp)
+		}
+	}
+
+	if value := quantile([]float64{5}, 0.99); value != 5 {
+		t.Errorf("FAIL: single item quantile=%f != 5", value)
+	}
+}
+
+func TestMultiHistogram_Quantiles(t *testing.T) {
+	multi := &MultiHistogram{Quantiles: []float64{0.75}, Stats: StatMax}
+	multi.Record("a", 1)
+	multi.Record("a", 3)
+
+	CheckValues(t, "multi", multi.ReadMeter(1*time.Second), map[string]float64{
+		"a.p75": 2.5,
+		"a.max": 3,
+	})
+}
+
 func CheckDist(t *testing.T, values map[string]float64, n int) {
 
 	if count := int(values["count"]); count != n {
@@ -88,14 +141,14 @@ func CheckDist(t *testing.T, values map[string]float64, n int) {
 	}
 
 	checkPercentile := func(p int) {
-		value := int(values[fmt.Sprintf("p%d", p)])
-		exp := int((float32(n) / 100) * float32(p))
+		value := values[fmt.Sprintf("p%d", p)]
+		exp := float64(n-1) / 100 * float64(p)
 
-		epsilon := int(float32(n) * 0.05)
+		epsilon := float64(n) * 0.05
 		lb, ub := exp-epsilon, exp+epsilon
 
-		if value < lb || value > ub || value > n {
-			t.Errorf("FAIL(%d): lb=%d < value=%d < ub=%d < max=%d", n, lb, value, ub, n)
+		if value < lb || value > ub || value > float64(n) {
+			t.Errorf("FAIL(%d): lb=%f < value=%f < ub=%f < max=%d", n, lb, value, ub, n)
 		}
 	}
 
@@ -0,0 +1,419 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultSketchAccuracy is used if Accuracy is not set in Sketch.
+const DefaultSketchAccuracy = 0.01
+
+// DefaultSketchBins is used if MaxBins is not set in Sketch.
+const DefaultSketchBins = 2048
+
+// DefaultQuantiles are the quantiles reported by SketchHistogram if Quantiles
+// is not set.
+var DefaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// Sketch is a quantile sketch with a bounded relative error based on DDSketch.
+// Values are bucketed into logarithmically sized bins such that any quantile
+// returned by the sketch is within Accuracy of the exact value relative to that
+// value. Two sketches with the same accuracy can be merged without any loss of
+// precision.
+//
+// The number of bins is bounded by MaxBins and the lowest bins are collapsed
+// together when the bound is exceeded which only affects the accuracy of the
+// lowest quantiles. NaN and infinite values are ignored.
+//
+// Sketch is not go-routine safe.
+type Sketch struct {
+
+	// Accuracy is the relative accuracy of the quantiles returned by the
+	// sketch. Defaults to DefaultSketchAccuracy.
+	Accuracy float64
+
+	// MaxBins is the maximum number of bins used for positive and negative
+	// values. Defaults to DefaultSketchBins.
+	MaxBins int
+
+	gamma    float64
+	logGamma float64
+
+	positive sketchBins
+	negative sketchBins
+	zeros    uint64
+
+	count    uint64
+	min, max float64
+	sum      float64
+}
+
+// NewSketch returns a new sketch with the given relative accuracy.
+func NewSketch(accuracy float64) *Sketch {
+	return &Sketch{Accuracy: accuracy}
+}
+
+func (sketch *Sketch) init() {
+	if sketch.gamma != 0 {
+		return
+	}
+
+	if sketch.Accuracy <= 0 || sketch.Accuracy >= 1 {
+		sketch.Accuracy = DefaultSketchAccuracy
+	}
+
+	if sketch.MaxBins <= 0 {
+		sketch.MaxBins = DefaultSketchBins
+	}
+
+	sketch.gamma = (1 + sketch.Accuracy) / (1 - sketch.Accuracy)
+	sketch.logGamma = math.Log(sketch.gamma)
+}
+
+// Record adds the given value to the sketch.
+func (sketch *Sketch) Record(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+
+	sketch.init()
+
+	switch {
+	case value > 0:
+		sketch.positive.add(sketch.index(value), 1, sketch.MaxBins)
+	case value < 0:
+		sketch.negative.add(sketch.index(-value), 1, sketch.MaxBins)
+	default:
+		sketch.zeros++
+	}
+
+	if sketch.count == 0 || value < sketch.min {
+		sketch.min = value
+	}
+
+	if sketch.count == 0 || value > sketch.max {
+		sketch.max = value
+	}
+
+	sketch.count++
+	sketch.sum += value
+}
+
+// Merge adds all the values recorded in the other sketch to this sketch. An
+// error is returned if the two sketches don't have the same accuracy.
+func (sketch *Sketch) Merge(other *Sketch) error {
+	if other.count == 0 {
+		return nil
+	}
+
+	sketch.init()
+
+	if sketch.gamma != other.gamma {
+		return fmt.Errorf("incompatible sketch accuracy: %g != %g", sketch.Accuracy, other.Accuracy)
+	}
+
+	for i, count := range other.positive.counts {
+		if count > 0 {
+			sketch.positive.add(other.positive.offset+i, count, sketch.MaxBins)
+		}
+	}
+
+	for i, count := range other.negative.counts {
+		if count > 0 {
+			sketch.negative.add(other.negative.offset+i, count, sketch.MaxBins)
+		}
+	}
+
+	sketch.zeros += other.zeros
+
+	if sketch.count == 0 || other.min < sketch.min {
+		sketch.min = other.min
+	}
+
+	if sketch.count == 0 || other.max > sketch.max {
+		sketch.max = other.max
+	}
+
+	sketch.count += other.count
+	sketch.sum += other.sum
+
+	return nil
+}
+
+// Reset discards all the values recorded in the sketch without releasing its
+// memory.
+func (sketch *Sketch) Reset() {
+	sketch.positive.reset()
+	sketch.negative.reset()
+	sketch.zeros = 0
+
+	sketch.count = 0
+	sketch.min, sketch.max = 0, 0
+	sketch.sum = 0
+}
+
+// Count returns the number of values recorded in the sketch.
+func (sketch *Sketch) Count() uint64 { return sketch.count }
+
+// Min returns the smallest value recorded in the sketch.
+func (sketch *Sketch) Min() float64 { return sketch.min }
+
+// Max returns the largest value recorded in the sketch.
+func (sketch *Sketch) Max() float64 { return sketch.max }
+
+// Sum returns the sum of all the values recorded in the sketch.
+func (sketch *Sketch) Sum() float64 { return sketch.sum }
+
+// Quantile returns an approximation of the given quantile which must be between
+// 0 and 1. Returns 0 if the sketch is empty.
+func (sketch *Sketch) Quantile(q float64) float64 {
+	if sketch.count == 0 {
+		return 0
+	}
+
+	if q <= 0 {
+		return sketch.min
+	}
+
+	if q >= 1 {
+		return sketch.max
+	}
+
+	rank := q * float64(sketch.count-1)
+
+	var value float64
+
+	if rank < float64(sketch.negative.total) {
+		value = -sketch.value(sketch.negative.rankDesc(rank))
+
+	} else if rank -= float64(sketch.negative.total); rank < float64(sketch.zeros) {
+		value = 0
+
+	} else {
+		value = sketch.value(sketch.positive.rankAsc(rank - float64(sketch.zeros)))
+	}
+
+	return math.Max(sketch.min, math.Min(sketch.max, value))
+}
+
+func (sketch *Sketch) index(value float64) int {
+	return int(math.Ceil(math.Log(value) / sketch.logGamma))
+}
+
+func (sketch *Sketch) value(index int) float64 {
+	return 2 * math.Pow(sketch.gamma, float64(index)) / (sketch.gamma + 1)
+}
+
+// sketchBins is a dense array of bin counts where counts[0] holds the count of
+// the bin with the offset index.
+type sketchBins struct {
+	counts []uint64
+	offset int
+	total  uint64
+}
+
+func (bins *sketchBins) reset() {
+	bins.counts = bins.counts[:0]
+	bins.offset = 0
+	bins.total = 0
+}
+
+func (bins *sketchBins) add(index int, count uint64, maxBins int) {
+	bins.total += count
+
+	if len(bins.counts) == 0 {
+		bins.counts = append(bins.counts, count)
+		bins.offset = index
+		return
+	}
+
+	top := bins.offset + len(bins.counts) - 1
+
+	if index < bins.offset {
+
+		// Values below the lowest bin that can be kept are collapsed into it.
+		if low := top - maxBins + 1; index < low {
+			index = low
+		}
+
+		if n := bins.offset - index; n > 0 {
+			bins.counts = append(make([]uint64, n, n+len(bins.counts)), bins.counts...)
+			bins.offset = index
+		}
+
+	} else if index > top {
+		bins.counts = append(bins.counts, make([]uint64, index-top)...)
+
+		if extra := len(bins.counts) - maxBins; extra > 0 {
+			var collapsed uint64
+			for _, c := range bins.counts[:extra] {
+				collapsed += c
+			}
+
+			n := copy(bins.counts, bins.counts[extra:])
+			bins.counts = bins.counts[:n]
+			bins.counts[0] += collapsed
+			bins.offset += extra
+		}
+	}
+
+	bins.counts[index-bins.offset] += count
+}
+
+// rankAsc returns the index of the bin that contains the given rank when
+// counting from the lowest bin.
+func (bins *sketchBins) rankAsc(rank float64) int {
+	var sum uint64
+
+	for i, count := range bins.counts {
+		if sum += count; float64(sum) > rank {
+			return bins.offset + i
+		}
+	}
+
+	return bins.offset + len(bins.counts) - 1
+}
+
+// rankDesc returns the index of the bin that contains the given rank when
+// counting from the highest bin.
+func (bins *sketchBins) rankDesc(rank float64) int {
+	var sum uint64
+
+	for i := len(bins.counts) - 1; i >= 0; i-- {
+		if sum += bins.counts[i]; float64(sum) > rank {
+			return bins.offset + i
+		}
+	}
+
+	return bins.offset
+}
+
+// SketchHistogram aggregates metrics over a histogram of values using a Sketch.
+//
+// Unlike Histogram, every recorded value is accounted for in the reported
+// percentiles which are guaranteed to be within Accuracy of the exact value
+// relative to that value. Memory usage is bounded by MaxBins and neither
+// Record nor ReadMeter need to allocate once the sketch has grown to the range
+// of recorded values.
+//
+// ReadMeter will compute the configured quantiles along with the count, min,
+// max and avg over all the values recorded since the last call to ReadMeter.
+//
+// SketchHistogram is completely go-routine safe.
+type SketchHistogram struct {
+
+	// Accuracy is the relative accuracy of the reported quantiles. Defaults
+	// to DefaultSketchAccuracy. Should not be modified after construction.
+	Accuracy float64
+
+	// MaxBins bounds the memory used by the sketch. Defaults to
+	// DefaultSketchBins. Should not be modified after construction.
+	MaxBins int
+
+	// Quantiles are the quantiles between 0 and 1 that will be reported. Each
+	// quantile is reported using a percentile suffix such that 0.99 becomes
+	// p99 and 0.999 becomes p999. Defaults to DefaultQuantiles. Should not be
+	// modified after construction.
+	Quantiles []float64
+
+	// Unit is the optional unit of the recorded values which is reported
+	// along with the values. Should not be modified after construction.
+	Unit string
+
+	// Help is an optional description of the histogram which is reported along
+	// with the values. Should not be modified after construction.
+	Help string
+
+	mutex  sync.Mutex
+	sketch *Sketch
+	clock  clockRef
+}
+
+// Record adds the given value to the histogram.
+func (dist *SketchHistogram) Record(value float64) {
+	dist.mutex.Lock()
+
+	dist.get().Record(value)
+
+	dist.mutex.Unlock()
+}
+
+// RecordDuration similar to Record but with time.Duration values.
+func (dist *SketchHistogram) RecordDuration(duration time.Duration) {
+	dist.Record(float64(duration) / float64(time.Second))
+}
+
+// RecordSince records a duration elapsed since the given time.
+func (dist *SketchHistogram) RecordSince(t0 time.Time) {
+	dist.RecordDuration(dist.clock.Get().Now().Sub(t0))
+}
+
+// SetClock sets the clock used by RecordSince.
+func (dist *SketchHistogram) SetClock(clock Clock) {
+	dist.clock.Set(clock)
+}
+
+// Merge adds all the values recorded in the given sketch to the histogram. An
+// error is returned if the sketch doesn't have the same accuracy as the
+// histogram.
+func (dist *SketchHistogram) Merge(sketch *Sketch) error {
+	dist.mutex.Lock()
+	defer dist.mutex.Unlock()
+
+	return dist.get().Merge(sketch)
+}
+
+// ReadMeter computes the configured quantiles along with the count, min, max
+// and avg over the recorded values. All recorded values are then discarded
+// from the histogram.
+func (dist *SketchHistogram) ReadMeter(_ time.Duration) map[string]float64 {
+	dist.mutex.Lock()
+	defer dist.mutex.Unlock()
+
+	sketch := dist.get()
+	if sketch.Count() == 0 {
+		return make(map[string]float64)
+	}
+
+	quantiles := dist.Quantiles
+	if len(quantiles) == 0 {
+		quantiles = DefaultQuantiles
+	}
+
+	values := make(map[string]float64, len(quantiles)+4)
+	values["count"] = float64(sketch.Count())
+	values["min"] = sketch.Min()
+	values["max"] = sketch.Max()
+	values["avg"] = sketch.Sum() / float64(sketch.Count())
+
+	for _, q := range quantiles {
+		values[percentileSuffix(q)] = sketch.Quantile(q)
+	}
+
+	sketch.Reset()
+	return values
+}
+
+// ReadSamples is similar to ReadMeter but reports the values as samples where
+// the percentiles are distinguished from the other statistics.
+func (dist *SketchHistogram) ReadSamples(delta time.Duration) []Sample {
+	return histogramSamples(dist.ReadMeter(delta), dist.Unit, dist.Help)
+}
+
+func (dist *SketchHistogram) get() *Sketch {
+	if dist.sketch == nil {
+		dist.sketch = &Sketch{Accuracy: dist.Accuracy, MaxBins: dist.MaxBins}
+		dist.sketch.init()
+	}
+	return dist.sketch
+}
+
+// GetSketchHistogram returns the sketch histogram registered with the given key
+// or creates a new one and registers it.
+func GetSketchHistogram(prefix string) *SketchHistogram {
+	return GetOrAdd(prefix, new(SketchHistogram)).(*SketchHistogram)
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func CheckQuantile(t *testing.T, title string, sketch *Sketch, values []float64, q float64) {
+	exp := values[int(q*float64(len(values)-1))]
+
+	if value := sketch.Quantile(q); math.Abs(value-exp) > math.Abs(exp)*sketch.Accuracy {
+		t.Errorf("FAIL(%s): q%g=%g != %g", title, q, value, exp)
+	}
+}
+
+func TestSketch_Accuracy(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	sketch := NewSketch(0.01)
+
+	var values []float64
+	for i := 0; i < 100000; i++ {
+		value := math.Exp(rng.NormFloat64() * 3)
+		if i%10 == 0 {
+			value = -value
+		}
+
+		values = append(values, value)
+		sketch.Record(value)
+	}
+	sort.Float64s(values)
+
+	for _, q := range []float64{0, 0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999, 0.9999, 1} {
+		CheckQuantile(t, "accuracy", sketch, values, q)
+	}
+
+	if sketch.Count() != uint64(len(values)) {
+		t.Errorf("FAIL: count=%d != %d", sketch.Count(), len(values))
+	}
+
+	if sketch.Min() != values[0] || sketch.Max() != values[len(values)-1] {
+		t.Errorf("FAIL: min=%g max=%g", sketch.Min(), sketch.Max())
+	}
+}
+
+func TestSketch_Merge(t *testing.T) {
+	a, b := NewSketch(0.01), NewSketch(0.01)
+
+	var values []float64
+	for i := 0; i < 1000; i++ {
+		values = append(values, float64(i))
+		if i%2 == 0 {
+			a.Record(float64(i))
+		} else {
+			b.Record(float64(i))
+		}
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("FAIL: unexpected merge error: %s", err)
+	}
+
+	if a.Count() != 1000 || a.Min() != 0 || a.Max() != 999 || a.Sum() != 999*1000/2 {
+		t.Errorf("FAIL: count=%d min=%g max=%g sum=%g", a.Count(), a.Min(), a.Max(), a.Sum())
+	}
+
+	for _, q := range []float64{0.1, 0.5, 0.9, 0.99} {
+		CheckQuantile(t, "merge", a, values, q)
+	}
+
+	if err := a.Merge(NewSketch(0.05)); err != nil {
+		t.Errorf("FAIL: unexpected error when merging an empty sketch: %s", err)
+	}
+
+	c := NewSketch(0.05)
+	c.Record(1)
+
+	if err := a.Merge(c); err == nil {
+		t.Errorf("FAIL: expected merge error with incompatible accuracy")
+	}
+}
+
+func TestSketch_MaxBins(t *testing.T) {
+	sketch := &Sketch{Accuracy: 0.01, MaxBins: 100}
+
+	for i := 0; i < 1000; i++ {
+		sketch.Record(math.Pow(1.1, float64(i%500)))
+	}
+
+	if n := len(sketch.positive.counts); n > 100 {
+		t.Errorf("FAIL: bins=%d > 100", n)
+	}
+
+	if p99, exp := sketch.Quantile(0.99), math.Pow(1.1, 494); math.Abs(p99-exp) > exp*0.01 {
+		t.Errorf("FAIL: p99=%g != %g", p99, exp)
+	}
+
+	sketch.Reset()
+	sketch.Record(0)
+
+	if sketch.Count() != 1 || sketch.Quantile(0.5) != 0 {
+		t.Errorf("FAIL: unexpected sketch after reset count=%d", sketch.Count())
+	}
+}
+
+func TestSketchHistogram(t *testing.T) {
+	dist := &SketchHistogram{Quantiles: []float64{0.5, 0.999}}
+
+	for i := 0; i < 10000; i++ {
+		dist.Record(float64(i))
+	}
+
+	values := dist.ReadMeter(1 * time.Second)
+
+	CheckValues(t, "stats", map[string]float64{
+		"count": values["count"],
+		"min":   values["min"],
+		"max":   values["max"],
+		"avg":   values["avg"],
+	}, map[string]float64{"count": 10000, "min": 0, "max": 9999, "avg": 4999.5})
+
+	for key, exp := range map[string]float64{"p50": 4999, "p999": 9989} {
+		if value, ok := values[key]; !ok || math.Abs(value-exp) > exp*0.01 {
+			t.Errorf("FAIL: %s=%g != %g", key, value, exp)
+		}
+	}
+
+	if values := dist.ReadMeter(1 * time.Second); len(values) != 0 {
+		t.Errorf("FAIL: expected empty read %v", values)
+	}
+}
+
+func TestPercentileSuffix(t *testing.T) {
+	for q, exp := range map[float64]string{
+		0.5: "p50", 0.9: "p90", 0.99: "p99", 0.999: "p999", 0.05: "p05", 1: "p100",
+	} {
+		if suffix := percentileSuffix(q); suffix != exp {
+			t.Errorf("FAIL: suffix mismatch %s != %s", suffix, exp)
+		}
+
+		if value, ok := parsePercentile(exp); !ok || value != q {
+			t.Errorf("FAIL: percentile mismatch %g != %g", value, q)
+		}
+	}
+}
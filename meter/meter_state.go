@@ -10,6 +10,11 @@ import (
 // State reports the value 1.0 for a given state until a new state is
 // recorded. This can be useful to record infrequent changes in program state.
 type State struct {
+
+	// Help is an optional description of the state which is reported along
+	// with the values. Should not be modified after construction.
+	Help string
+
 	value string
 	mutex sync.Mutex
 }
@@ -45,6 +50,11 @@ func (state *State) ReadMeter(delta time.Duration) map[string]float64 {
 	return result
 }
 
+// ReadSamples is similar to ReadMeter but reports the state as a gauge sample.
+func (state *State) ReadSamples(delta time.Duration) []Sample {
+	return toSamples(state.ReadMeter(delta), KindGauge, "", state.Help)
+}
+
 // GetState returns the state registered with the given key or creates a new one
 // and registers it.
 func GetState(prefix string) *State {
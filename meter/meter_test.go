@@ -45,3 +45,17 @@ func CheckValues(t *testing.T, title string, values map[string]float64, exp map[
 		}
 	}
 }
+
+func EqualValues(values map[string]float64, exp map[string]float64) bool {
+	if len(values) != len(exp) {
+		return false
+	}
+
+	for key, value := range values {
+		if expValue, ok := exp[key]; !ok || expValue != value {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package metertest
+
+import (
+	"sync"
+	"time"
+)
+
+// Epoch is the initial time of the clocks created by NewHarness.
+var Epoch = time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Clock is a fake meter.Clock whose time only moves when Set or Advance are
+// called.
+type Clock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []clockWaiter
+}
+
+type clockWaiter struct {
+	deadline time.Time
+	timeC    chan time.Time
+}
+
+// NewClock returns a new fake clock set to the given time.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (clock *Clock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	return clock.now
+}
+
+// After returns a channel which receives the time of the clock once it has
+// been advanced by the given duration.
+func (clock *Clock) After(d time.Duration) <-chan time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	timeC := make(chan time.Time, 1)
+
+	if d <= 0 {
+		timeC <- clock.now
+	} else {
+		clock.waiters = append(clock.waiters, clockWaiter{deadline: clock.now.Add(d), timeC: timeC})
+	}
+
+	return timeC
+}
+
+// Waiters returns the number of pending After calls which can be used to wait
+// for a goroutine to block on the clock.
+func (clock *Clock) Waiters() int {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	return len(clock.waiters)
+}
+
+// Advance moves the clock forward by the given duration.
+func (clock *Clock) Advance(d time.Duration) {
+	clock.Set(clock.Now().Add(d))
+}
+
+// Set sets the time of the clock and wakes up any pending After calls whose
+// deadline was reached.
+func (clock *Clock) Set(now time.Time) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	clock.now = now
+
+	var waiters []clockWaiter
+
+	for _, waiter := range clock.waiters {
+		if waiter.deadline.After(now) {
+			waiters = append(waiters, waiter)
+		} else {
+			waiter.timeC <- now
+		}
+	}
+
+	clock.waiters = waiters
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+// Package metertest provides utilities to deterministically test code that
+// records meters: a fake clock, a recording handler and an isolated poller
+// which can be installed in place of the DefaultPoller.
+package metertest
+
+import (
+	"github.com/datacratic/gometer/meter"
+
+	"testing"
+	"time"
+)
+
+// Harness bundles an isolated poller driven by a fake clock with a recorder
+// which receives all the polled values. Meters can be registered via the
+// Poller's Load and GetOrAdd functions without affecting the DefaultPoller or,
+// for code which relies on the global functions, via Install.
+type Harness struct {
+	Clock    *Clock
+	Poller   *meter.Poller
+	Recorder *Recorder
+}
+
+// NewHarness returns a new harness whose clock is set to Epoch.
+func NewHarness() *Harness {
+	clock := NewClock(Epoch)
+	recorder := &Recorder{}
+
+	return &Harness{
+		Clock:    clock,
+		Recorder: recorder,
+		Poller: &meter.Poller{
+			Clock:    clock,
+			Handlers: []meter.Handler{recorder},
+		},
+	}
+}
+
+// Poll advances the clock by the given duration, polls the meters and returns
+// the polled samples once they were handled.
+func (harness *Harness) Poll(d time.Duration) []meter.Sample {
+	harness.Clock.Advance(d)
+	harness.Poller.PollNow()
+	return harness.Recorder.Last()
+}
+
+// Install redirects the global functions of the meter package (eg. Add, Load,
+// GetCounter) to the harness' poller until the end of the given test at which
+// point the previous poller is restored. Tests using Install must not run in
+// parallel with other tests relying on the global functions.
+func (harness *Harness) Install(tb testing.TB) {
+	previous := meter.SetDefaultPoller(harness.Poller)
+	tb.Cleanup(func() { meter.SetDefaultPoller(previous) })
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package metertest
+
+import (
+	"github.com/datacratic/gometer/meter"
+
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHarness(t *testing.T) {
+	harness := NewHarness()
+
+	var obj struct {
+		Requests *meter.Counter
+		Latency  *meter.Gauge
+	}
+	harness.Poller.Load(&obj, "svc")
+
+	if meter.Get("svc.Requests") != nil {
+		t.Fatal("FAIL: meters registered with the DefaultPoller")
+	}
+
+	obj.Requests.Count(10)
+	obj.Latency.ChangeDuration(3 * time.Second)
+
+	harness.Poll(2 * time.Second)
+	harness.Recorder.AssertCounterRate(t, "svc.Requests", 5, 0)
+	harness.Recorder.AssertValue(t, "svc.Latency", 3, 0)
+
+	obj.Requests.Count(1)
+
+	harness.Poll(500 * time.Millisecond)
+	harness.Recorder.AssertCounterRate(t, "svc.Requests", 2, 0)
+
+	harness.Poller.Unload(&obj, "svc")
+
+	harness.Poll(1 * time.Second)
+	harness.Recorder.AssertKeyAbsent(t, "svc.Requests")
+
+	if n := len(harness.Recorder.Batches()); n != 3 {
+		t.Errorf("FAIL: batches %d != 3", n)
+	}
+}
+
+func TestHarness_Install(t *testing.T) {
+	harness := NewHarness()
+
+	t.Run("install", func(t *testing.T) {
+		harness.Install(t)
+
+		counter := meter.GetCounter("svc.Installed")
+		counter.Count(4)
+
+		var obj struct{ Gauge *meter.Gauge }
+		meter.Load(&obj, "svc")
+		obj.Gauge.Change(2)
+
+		if meter.DefaultPoller.Get("svc.Installed") != nil {
+			t.Fatal("FAIL: meter registered with the DefaultPoller")
+		}
+
+		harness.Poll(2 * time.Second)
+		harness.Recorder.AssertCounterRate(t, "svc.Installed", 2, 0)
+		harness.Recorder.AssertValue(t, "svc.Gauge", 2, 0)
+	})
+
+	if meter.Get("svc.Installed") != nil {
+		t.Fatal("FAIL: DefaultPoller not restored")
+	}
+
+	if harness.Poller.Get("svc.Installed") == nil {
+		t.Fatal("FAIL: meter not registered with the harness")
+	}
+}
+
+func TestHarness_Background(t *testing.T) {
+	harness := NewHarness()
+	counter := harness.Poller.GetOrAdd("c", new(meter.Counter)).(*meter.Counter)
+
+	harness.Poller.Poll("", 10*time.Second)
+
+	for i := 1; i <= 3; i++ {
+		for harness.Clock.Waiters() == 0 {
+			time.Sleep(1 * time.Millisecond)
+		}
+
+		counter.Count(20)
+		harness.Clock.Advance(10 * time.Second)
+
+		for len(harness.Recorder.Batches()) < i {
+			time.Sleep(1 * time.Millisecond)
+		}
+
+		harness.Recorder.AssertCounterRate(t, "c", 2, 0)
+
+		if sample, _ := harness.Recorder.Get("c"); !sample.Timestamp.Equal(Epoch.Add(time.Duration(i) * 10 * time.Second)) {
+			t.Errorf("FAIL: unexpected timestamp %s", sample.Timestamp)
+		}
+	}
+
+	harness.Poller.Stop(context.Background())
+}
+
+func TestClock(t *testing.T) {
+	clock := NewClock(Epoch)
+
+	a, b := clock.After(1*time.Second), clock.After(2*time.Second)
+
+	clock.Advance(1 * time.Second)
+
+	select {
+	case now := <-a:
+		if !now.Equal(Epoch.Add(1 * time.Second)) {
+			t.Errorf("FAIL: unexpected time %s", now)
+		}
+	default:
+		t.Errorf("FAIL: expected a to fire")
+	}
+
+	select {
+	case <-b:
+		t.Errorf("FAIL: b fired early")
+	default:
+	}
+
+	if n := clock.Waiters(); n != 1 {
+		t.Errorf("FAIL: waiters %d != 1", n)
+	}
+
+	clock.Advance(1 * time.Second)
+	<-b
+}
+
+func TestHarness_Clock(t *testing.T) {
+	harness := NewHarness()
+
+	var obj struct {
+		Gauge      *meter.Gauge
+		Histogram  *meter.Histogram
+		Sketch     *meter.SketchHistogram
+		MultiGauge *meter.MultiGauge
+		MultiHist  *meter.MultiHistogram
+	}
+	harness.Poller.Load(&obj, "m")
+
+	t0 := harness.Clock.Now()
+	harness.Clock.Advance(3 * time.Second)
+
+	obj.Gauge.ChangeSince(t0)
+	obj.Histogram.RecordSince(t0)
+	obj.Sketch.RecordSince(t0)
+	obj.MultiGauge.ChangeSince("a", t0)
+	obj.MultiHist.RecordSince("a", t0)
+
+	harness.Poll(1 * time.Second)
+
+	harness.Recorder.AssertValue(t, "m.Gauge", 3, 0)
+	harness.Recorder.AssertValue(t, "m.Histogram.max", 3, 0)
+	harness.Recorder.AssertValue(t, "m.Sketch.max", 3, 0)
+	harness.Recorder.AssertValue(t, "m.MultiGauge.a", 3, 0)
+	harness.Recorder.AssertValue(t, "m.MultiHist.a.max", 3, 0)
+}
+
+func TestHarness_HTTPRetry(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	harness := NewHarness()
+	harness.Poller.Handle(&meter.HTTPHandler{URL: server.URL, Method: "POST", RetryDelay: 1 * time.Hour})
+	harness.Poller.GetOrAdd("g", &meter.Gauge{Value: 1})
+
+	harness.Poll(1 * time.Second)
+
+	// The retry waits for an hour on the fake clock.
+	for harness.Clock.Waiters() == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("FAIL: requests %d != 1", n)
+	}
+
+	harness.Clock.Advance(1 * time.Hour)
+
+	if err := harness.Poller.Stop(context.Background()); err != nil {
+		t.Errorf("FAIL: unexpected error: %s", err)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("FAIL: requests %d != 2", n)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package metertest
+
+import (
+	"github.com/datacratic/gometer/meter"
+
+	"math"
+	"sync"
+	"testing"
+)
+
+// Recorder is a meter.SampleHandler which records every batch of samples it
+// receives. The Assert functions check the values of the last batch where
+// keys are matched against the flattened key of the samples.
+type Recorder struct {
+	mutex   sync.Mutex
+	batches [][]meter.Sample
+}
+
+// HandleMeters records the given values as untyped samples.
+func (recorder *Recorder) HandleMeters(values map[string]float64) {
+	var samples []meter.Sample
+
+	for key, value := range values {
+		samples = append(samples, meter.Sample{Key: key, Value: value})
+	}
+
+	recorder.HandleSamples(samples)
+}
+
+// HandleSamples records the given samples.
+func (recorder *Recorder) HandleSamples(samples []meter.Sample) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.batches = append(recorder.batches, samples)
+}
+
+// Batches returns all the recorded batches of samples.
+func (recorder *Recorder) Batches() [][]meter.Sample {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	return append([][]meter.Sample(nil), recorder.batches...)
+}
+
+// Last returns the last recorded batch of samples or nil if nothing was
+// recorded.
+func (recorder *Recorder) Last() []meter.Sample {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if len(recorder.batches) == 0 {
+		return nil
+	}
+	return recorder.batches[len(recorder.batches)-1]
+}
+
+// Values returns the values of the last recorded batch with their labels
+// flattened into the keys.
+func (recorder *Recorder) Values() map[string]float64 {
+	return meter.FlattenSamples(recorder.Last())
+}
+
+// Get returns the sample of the last recorded batch associated with the given
+// flattened key.
+func (recorder *Recorder) Get(key string) (meter.Sample, bool) {
+	for _, sample := range recorder.Last() {
+		if sample.FlatKey() == key {
+			return sample, true
+		}
+	}
+	return meter.Sample{}, false
+}
+
+// Reset discards all the recorded batches.
+func (recorder *Recorder) Reset() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.batches = nil
+}
+
+// AssertValue fails the test if the value associated with the given key is
+// missing or differs from want by more than tol.
+func (recorder *Recorder) AssertValue(t testing.TB, key string, want, tol float64) {
+	t.Helper()
+
+	sample, ok := recorder.Get(key)
+	if !ok {
+		t.Errorf("FAIL(%s): key missing", key)
+		return
+	}
+
+	if math.Abs(sample.Value-want) > tol {
+		t.Errorf("FAIL(%s): value %g != %g ± %g", key, sample.Value, want, tol)
+	}
+}
+
+// AssertCounterRate fails the test if the given key is not a counter or if its
+// per second rate differs from want by more than tol.
+func (recorder *Recorder) AssertCounterRate(t testing.TB, key string, want, tol float64) {
+	t.Helper()
+
+	if sample, ok := recorder.Get(key); ok && sample.Kind != meter.KindCounter {
+		t.Errorf("FAIL(%s): kind %s is not a counter", key, sample.Kind)
+		return
+	}
+
+	recorder.AssertValue(t, key, want, tol)
+}
+
+// AssertKeyAbsent fails the test if the given key is present.
+func (recorder *Recorder) AssertKeyAbsent(t testing.TB, key string) {
+	t.Helper()
+
+	if sample, ok := recorder.Get(key); ok {
+		t.Errorf("FAIL(%s): unexpected value %g", key, sample.Value)
+	}
+}
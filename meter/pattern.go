@@ -39,3 +39,63 @@ func (pattern Pattern) Match(key string) (result []string, ok bool) {
 func (pattern Pattern) String() string {
 	return fmt.Sprintf("%s", []string(pattern))
 }
+
+// TagRule describes how a key should be split into a name and a set of tags.
+// Pattern is matched against the key using the Pattern type and the matched
+// groups can be referenced in Name and in the values of Tags using the {0},
+// {1}, etc. syntax.
+type TagRule struct {
+
+	// Pattern is the pattern that a key must match for the rule to apply.
+	Pattern string
+
+	// Name is the template of the name associated with the key. An empty name
+	// leaves the key unchanged.
+	Name string
+
+	// Tags contains the templates of the tags associated with the key.
+	Tags map[string]string
+}
+
+// Apply returns the name and the tags obtained by applying the rule to the
+// given key or false if the key doesn't match the rule's pattern.
+func (rule TagRule) Apply(key string) (name string, tags map[string]string, ok bool) {
+	groups, ok := NewPattern(rule.Pattern).Match(key)
+	if !ok {
+		return
+	}
+
+	name = key
+	if rule.Name != "" {
+		name = expandGroups(rule.Name, groups)
+	}
+
+	tags = make(map[string]string)
+	for tag, value := range rule.Tags {
+		tags[tag] = expandGroups(value, groups)
+	}
+
+	return
+}
+
+// applyTagRules applies the first rule matching the given key and returns the
+// resulting name and tags. The key is returned as the name along with an empty
+// set of tags if no rules match the key.
+func applyTagRules(rules []TagRule, key string) (string, map[string]string) {
+	for _, rule := range rules {
+		if name, tags, ok := rule.Apply(key); ok {
+			return name, tags
+		}
+	}
+
+	return key, make(map[string]string)
+}
+
+// expandGroups replaces all the {0}, {1}, etc. references in the given template
+// by the associated group.
+func expandGroups(template string, groups []string) string {
+	for i, group := range groups {
+		template = strings.Replace(template, fmt.Sprintf("{%d}", i), group, -1)
+	}
+	return template
+}
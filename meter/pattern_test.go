@@ -53,3 +53,28 @@ func patternFail(t *testing.T, pattern, key string) {
 		t.Errorf("FAIL(%v, %s): unexpected success -> %v", p, key, groups)
 	}
 }
+
+func TestTagRule(t *testing.T) {
+	rule := TagRule{
+		Pattern: "*.Histogram.*",
+		Name:    "{0}.latency",
+		Tags:    map[string]string{"stat": "{1}", "kind": "histogram"},
+	}
+
+	name, tags, ok := rule.Apply("a.b.Histogram.p99")
+	if !ok {
+		t.Fatalf("FAIL: unmatched")
+	}
+
+	if name != "a.b.latency" {
+		t.Errorf("FAIL: name mismatch '%s' != '%s'", name, "a.b.latency")
+	}
+
+	if tags["stat"] != "p99" || tags["kind"] != "histogram" || len(tags) != 2 {
+		t.Errorf("FAIL: tags mismatch %v", tags)
+	}
+
+	if _, _, ok := rule.Apply("a.b.Counter"); ok {
+		t.Errorf("FAIL: unexpected match")
+	}
+}
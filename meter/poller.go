@@ -3,26 +3,82 @@
 package meter
 
 import (
+	"context"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 // Poller periodically calls ReadMeter on all the meters registered via the Add
 // function and forwards the aggregated values to all the configured handlers.
+//
+// Handlers are called asynchronously from their own goroutine such that a slow
+// handler doesn't delay the other handlers nor block the registration of
+// meters. See HandlerOptions for more details.
 type Poller struct {
 
 	// Meters contains the initial list of meters to be polled. Should not be
 	// read or modified after calling Init.
 	Meters map[string]Meter
 
-	// Handlers contains the initial list of handlers. Should not be read or
-	// modified after calling init.
+	// Handlers contains the initial list of handlers. Handlers which also
+	// implement Transformer (eg. TranslationHandler) are applied as
+	// transformers after the Transformers instead of receiving the values.
+	// Should not be read or modified after calling init.
 	Handlers []Handler
 
+	// Transformers contains the initial list of transformers applied to the
+	// polled values before they're dispatched to the handlers. Should not be
+	// read or modified after calling init.
+	Transformers []Transformer
+
+	// HandlerOptions is used to dispatch the values to the handlers which
+	// are not added via HandleWith.
+	HandlerOptions HandlerOptions
+
+	// Clock is used to time the polls. Defaults to SystemClock. The clock is
+	// also set on the meters and handlers which implement ClockSetter when
+	// they are added. Should not be modified after adding meters or handlers.
+	Clock Clock
+
+	// Align aligns the polls on the wall-clock multiples of the polling rate
+	// (eg. every 10 seconds on the 10 second marks) such that the values of
+	// multiple processes polled at the same rate are reported at the same
+	// time. Should not be modified after calling Poll.
+	Align bool
+
+	// Jitter is the upper bound of a random offset added to the aligned
+	// polling times to spread the load caused by multiple processes. The
+	// offset is picked once when calling Poll such that every poll falls at
+	// the same point of its interval. Only used if Align is set.
+	Jitter time.Duration
+
+	// Dropped counts the number of polls that were dropped because the queue
+	// of a handler was full. It's only polled if it's explicitly added as a
+	// meter (see DroppedKey).
+	Dropped CumulativeCounter
+
 	mutex sync.Mutex
 
+	dispatchers []*dispatcher
+	dispatched  int
+	options     []HandlerOptions
+
 	rate   time.Duration
 	prefix string
+	offset time.Duration
+	last   time.Time
+
+	// reads contains the time at which each meter was last read.
+	reads map[string]time.Time
+
+	groups  map[time.Duration]*Poller
+	dropped *CumulativeCounter
+
+	stopC chan struct{}
+	doneC chan struct{}
 }
 
 // Get returns the meter associated with the given key or nil if no such meter
@@ -35,14 +91,13 @@ func (poller *Poller) Get(key string) Meter {
 }
 
 // Add registers the given meter which will be polled periodically and
-// associates it with the given key. If the key is already registered then the
-// old meter will be replaced by the given meter.
+// associates it with the given key. Returns false if the key is already
+// registered. The values of the first poll of the meter are normalized using
+// the time elapsed since the meter was added.
 func (poller *Poller) Add(key string, meter Meter) bool {
 	poller.mutex.Lock()
 	defer poller.mutex.Unlock()
 
-	meter.ReadMeter(poller.rate)
-
 	if poller.Meters == nil {
 		poller.Meters = make(map[string]Meter)
 	}
@@ -51,10 +106,33 @@ func (poller *Poller) Add(key string, meter Meter) bool {
 		return false
 	}
 
+	if poller.reads == nil {
+		poller.reads = make(map[string]time.Time)
+	}
+
+	if setter, ok := meter.(ClockSetter); ok {
+		setter.SetClock(poller.clock())
+	}
+
 	poller.Meters[key] = meter
+	poller.reads[key] = poller.clock().Now()
 	return true
 }
 
+// GetOrAdd registers the given meter with the given key if it's not already
+// registered or returns the meter associated with the given key.
+func (poller *Poller) GetOrAdd(key string, meter Meter) Meter {
+	for {
+		if old := poller.Get(key); old != nil {
+			return old
+		}
+
+		if poller.Add(key, meter) {
+			return meter
+		}
+	}
+}
+
 // Remove unregisters the given meter which will no longer be polled
 // periodically.
 func (poller *Poller) Remove(key string) {
@@ -63,10 +141,12 @@ func (poller *Poller) Remove(key string) {
 
 	if poller.Meters != nil {
 		delete(poller.Meters, key)
+		delete(poller.reads, key)
 	}
 }
 
-// Handle adds the given handler to the list of handler to execute.
+// Handle adds the given handler to the list of handler to execute. Handlers
+// which implement Transformer are applied as transformers.
 func (poller *Poller) Handle(handler Handler) {
 	poller.mutex.Lock()
 	defer poller.mutex.Unlock()
@@ -74,9 +154,110 @@ func (poller *Poller) Handle(handler Handler) {
 	poller.Handlers = append(poller.Handlers, handler)
 }
 
+// Transform adds the given transformer to the list of transformers applied to
+// the polled values before they're dispatched to the handlers.
+func (poller *Poller) Transform(transformer Transformer) {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	poller.Transformers = append(poller.Transformers, transformer)
+}
+
+// HandleWith adds the given handler to the list of handler to execute where
+// the polled values are dispatched to the handler using the given options.
+func (poller *Poller) HandleWith(handler Handler, options HandlerOptions) {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	for len(poller.options) < len(poller.Handlers) {
+		poller.options = append(poller.options, poller.HandlerOptions)
+	}
+
+	poller.Handlers = append(poller.Handlers, handler)
+	poller.options = append(poller.options, options)
+}
+
+// dispatch creates the dispatchers of the handlers which don't have one yet,
+// either because they were just added or because the poller was stopped. The
+// handlers that implement Transformer are only applied as transformers so they
+// don't get a dispatcher. Must be called with the mutex held.
+func (poller *Poller) dispatch() []*dispatcher {
+	for ; poller.dispatched < len(poller.Handlers); poller.dispatched++ {
+		i := poller.dispatched
+
+		if i == len(poller.options) {
+			poller.options = append(poller.options, poller.HandlerOptions)
+		}
+
+		if _, ok := poller.Handlers[i].(Transformer); ok {
+			continue
+		}
+
+		dispatcher := poller.newDispatcher(poller.Handlers[i], poller.options[i])
+		poller.dispatchers = append(poller.dispatchers, dispatcher)
+	}
+
+	return poller.dispatchers
+}
+
+// newDispatcher creates the dispatcher of the given handler and sets the clock
+// of the handler.
+func (poller *Poller) newDispatcher(handler Handler, options HandlerOptions) *dispatcher {
+	if setter, ok := handler.(ClockSetter); ok {
+		setter.SetClock(poller.clock())
+	}
+
+	return newDispatcher(handler, options, poller, poller.droppedCounter(), poller.clock())
+}
+
+// droppedCounter returns the counter of dropped polls which, for groups, is the
+// counter of the poller that created the group.
+func (poller *Poller) droppedCounter() *CumulativeCounter {
+	if poller.dropped != nil {
+		return poller.dropped
+	}
+	return &poller.Dropped
+}
+
+// Group returns the group of meters polled at the given rate which is created
+// if it doesn't exist. A group is a Poller with its own set of meters and
+// handlers which is started and stopped along with this poller and whose keys
+// are prefixed with the same prefix. Groups inherit the Clock, HandlerOptions,
+// Align and Jitter settings of the poller when they are created and their dropped
+// polls are counted by the Dropped counter of this poller.
+func (poller *Poller) Group(rate time.Duration) *Poller {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	if group, ok := poller.groups[rate]; ok {
+		return group
+	}
+
+	group := &Poller{
+		Clock:          poller.Clock,
+		HandlerOptions: poller.HandlerOptions,
+		Align:          poller.Align,
+		Jitter:         poller.Jitter,
+		dropped:        poller.droppedCounter(),
+	}
+
+	if poller.groups == nil {
+		poller.groups = make(map[time.Duration]*Poller)
+	}
+	poller.groups[rate] = group
+
+	if poller.rate != 0 {
+		group.Poll(poller.prefix, rate)
+	}
+
+	return group
+}
+
 // Poll starts a background goroutine which will periodically poll the
 // registered meters at the given rate and prepend all the polled keys with the
-// given prefix.
+// given prefix. The first poll happens once the first interval has elapsed.
+// Groups created via Group are also started at their own rate. Panics if the
+// poller is already started.
 func (poller *Poller) Poll(prefix string, rate time.Duration) {
 	poller.mutex.Lock()
 	defer poller.mutex.Unlock()
@@ -86,76 +267,341 @@ func (poller *Poller) Poll(prefix string, rate time.Duration) {
 	}
 	poller.rate = rate
 	poller.prefix = prefix
+	poller.last = poller.clock().Now()
 
-	go func() {
-		for tickC := time.Tick(rate); ; <-tickC {
-			poller.poll()
+	poller.offset = 0
+	if poller.Align && poller.Jitter > 0 {
+		jitter := poller.Jitter
+		if jitter > rate {
+			jitter = rate
 		}
-	}()
+		poller.offset = time.Duration(rand.Int63n(int64(jitter)))
+	}
+
+	// Start the dispatchers ahead of the first poll to avoid delaying it.
+	poller.dispatch()
+
+	poller.stopC = make(chan struct{})
+	poller.doneC = make(chan struct{})
+
+	go poller.run(poller.last, poller.stopC, poller.doneC)
+
+	for rate, group := range poller.groups {
+		group.Poll(prefix, rate)
+	}
 }
 
-func (poller *Poller) poll() {
+// Stop stops the periodic polling of the meters started by Poll. The meters are
+// then polled one last time to report the values of the last partial interval
+// which are normalized using the time elapsed since the previous poll. These
+// values are queued even if the queue of a handler is full unless the context
+// is done first in which case they are dropped and the context error is
+// returned. Finally,
+// Stop waits for all the queued values to be handled and for all the handlers
+// that implement the Flusher interface to drain their buffered values or until
+// the context is done after which the goroutines of the handlers are released.
+// The groups of the poller are also stopped.
+func (poller *Poller) Stop(ctx context.Context) error {
 	poller.mutex.Lock()
-	defer poller.mutex.Unlock()
 
-	result := make(map[string]float64)
+	stopC, doneC := poller.stopC, poller.doneC
+	poller.stopC, poller.doneC = nil, nil
+
+	poller.mutex.Unlock()
+
+	var err error
+
+	if stopC != nil {
+		close(stopC)
+		<-doneC
+
+		// The values of the last interval are queued regardless of the
+		// dispatch policy of the handlers as they can't be polled again.
+		samples, dispatchers := poller.read(poller.elapsed())
+
+		for _, dispatcher := range dispatchers {
+			if queueErr := dispatcher.Queue(ctx, samples); err == nil {
+				err = queueErr
+			}
+		}
+	}
+
+	poller.mutex.Lock()
+
+	dispatchers := poller.dispatch()
+	poller.dispatchers, poller.dispatched = nil, 0
+	poller.rate = 0
+
+	var groups []*Poller
+	for _, group := range poller.groups {
+		groups = append(groups, group)
+	}
+
+	poller.mutex.Unlock()
+
+	for _, group := range groups {
+		if groupErr := group.Stop(ctx); err == nil {
+			err = groupErr
+		}
+	}
+
+	for _, dispatcher := range dispatchers {
+		if flushErr := dispatcher.Flush(ctx); err == nil {
+			err = flushErr
+		}
+
+		if flusher, ok := dispatcher.handler.(Flusher); ok {
+			if flushErr := flusher.Flush(ctx); err == nil {
+				err = flushErr
+			}
+		}
+
+		dispatcher.Close()
+	}
+
+	return err
+}
+
+// run polls the meters until stopC is closed where the polls are scheduled
+// from the given start time at which Poll was called.
+func (poller *Poller) run(start time.Time, stopC, doneC chan struct{}) {
+	defer close(doneC)
+
+	clock := poller.clock()
+
+	last := start
+	next := poller.schedule(start, start)
+
+	for {
+		select {
+		case <-clock.After(next.Sub(clock.Now())):
+		case <-stopC:
+			return
+		}
+
+		now := clock.Now()
+		poller.poll(now.Sub(last))
+
+		last = now
+		next = poller.schedule(next, now)
+	}
+}
+
+// schedule returns the time of the first poll following the given time where
+// prev is the time at which the previous poll was scheduled. Polls that were
+// missed because the previous poll took too long are skipped.
+func (poller *Poller) schedule(prev, now time.Time) time.Time {
+	next := prev.Add(poller.rate)
+
+	if poller.Align {
+		next = now.Truncate(poller.rate).Add(poller.offset)
+	}
+
+	for !next.After(now) {
+		next = next.Add(poller.rate)
+	}
+
+	return next
+}
+
+// poll reads all the meters and dispatches their values to the handlers.
+func (poller *Poller) poll(delta time.Duration) {
+	samples, dispatchers := poller.read(delta)
+
+	for _, dispatcher := range dispatchers {
+		dispatcher.Dispatch(samples)
+	}
+}
+
+// read reads all the meters and returns their transformed values along with the
+// dispatchers of the handlers. The values of each meter are normalized using
+// the time elapsed since the meter was last read or added and the given delta
+// is only used for meters that were never read (ie. the initial Meters). Meters for which no time has elapsed
+// (eg. PollNow called twice without moving the clock) are skipped until the
+// next poll as their values can't be normalized.
+func (poller *Poller) read(delta time.Duration) ([]Sample, []*dispatcher) {
+	poller.mutex.Lock()
+
+	now := poller.clock().Now()
+	poller.last = now
+
+	if poller.reads == nil {
+		poller.reads = make(map[string]time.Time)
+	}
+
+	var samples []Sample
 
 	for prefix, meter := range poller.Meters {
-		for suffix, value := range meter.ReadMeter(poller.rate) {
-			result[Join(poller.prefix, prefix, suffix)] = value
+		elapsed := delta
+		if last, ok := poller.reads[prefix]; ok {
+			elapsed = now.Sub(last)
+
+		} else if setter, ok := meter.(ClockSetter); ok {
+			setter.SetClock(poller.clock())
+		}
+
+		if elapsed <= 0 {
+			continue
+		}
+		poller.reads[prefix] = now
+
+		for _, sample := range readSamples(meter, elapsed) {
+			sample.Key = Join(poller.prefix, prefix, sample.Key)
+			sample.Timestamp = now
+			sample.Interval = elapsed
+			samples = append(samples, sample)
 		}
 	}
 
+	transformers := append([]Transformer(nil), poller.Transformers...)
 	for _, handler := range poller.Handlers {
-		handler.HandleMeters(result)
+		if transformer, ok := handler.(Transformer); ok {
+			transformers = append(transformers, transformer)
+		}
+	}
+
+	dispatchers := poller.dispatch()
+
+	poller.mutex.Unlock()
+
+	for _, transformer := range transformers {
+		samples = transformer.Transform(samples)
 	}
+
+	return samples, dispatchers
+}
+
+// PollNow immediately polls the meters of the poller and of its groups and waits
+// for the values to be handled by all the handlers. The values of the meters
+// that were never read are normalized using the time elapsed since the last
+// poll or over a second if the poller was never polled.
+func (poller *Poller) PollNow() {
+	poller.poll(poller.elapsed())
+
+	poller.mutex.Lock()
+
+	dispatchers := poller.dispatch()
+
+	var groups []*Poller
+	for _, group := range poller.groups {
+		groups = append(groups, group)
+	}
+
+	poller.mutex.Unlock()
+
+	for _, dispatcher := range dispatchers {
+		dispatcher.Flush(context.Background())
+	}
+
+	for _, group := range groups {
+		group.PollNow()
+	}
+}
+
+// elapsed returns the time elapsed since the last poll.
+func (poller *Poller) elapsed() time.Duration {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	if poller.last.IsZero() {
+		return 1 * time.Second
+	}
+	return poller.clock().Now().Sub(poller.last)
+}
+
+func (poller *Poller) clock() Clock {
+	if poller.Clock != nil {
+		return poller.Clock
+	}
+	return SystemClock
 }
 
+// DroppedKey is the suggested key of the Dropped counter of a poller which is
+// not registered by default (eg. Add(DroppedKey, &DefaultPoller.Dropped)).
+const DroppedKey = "meter.dropped"
+
 // DefaultPoller is the Poller object used by the global Add, Remove and Handle
-// functions.
+// functions unless it was replaced via SetDefaultPoller.
 var DefaultPoller Poller
 
+// defaultPoller holds the poller set via SetDefaultPoller or nil if the global
+// functions should use DefaultPoller.
+var defaultPoller unsafe.Pointer
+
+// SetDefaultPoller redirects the global functions to the given poller and
+// returns the poller that they previously used. Passing nil restores the
+// DefaultPoller. This is mostly useful in tests to observe meters registered
+// through the global functions without polling them with the DefaultPoller.
+func SetDefaultPoller(poller *Poller) *Poller {
+	if poller == &DefaultPoller {
+		poller = nil
+	}
+	return loadedPoller(atomic.SwapPointer(&defaultPoller, unsafe.Pointer(poller)))
+}
+
+func getDefaultPoller() *Poller {
+	return loadedPoller(atomic.LoadPointer(&defaultPoller))
+}
+
+func loadedPoller(ptr unsafe.Pointer) *Poller {
+	if ptr == nil {
+		return &DefaultPoller
+	}
+	return (*Poller)(ptr)
+}
+
 // Get returns the meter associated with the given key or nil if no such meter
 // exists.
 func Get(key string) Meter {
-	return DefaultPoller.Get(key)
+	return getDefaultPoller().Get(key)
 }
 
 // Add associates the given meter with the given key and begins to periodically
 // poll the meter.
 func Add(key string, meter Meter) bool {
-	return DefaultPoller.Add(key, meter)
+	return getDefaultPoller().Add(key, meter)
 }
 
 // GetOrAdd registers the given meter with the given key if it's not already
 // registered or returns the meter associated with the given key.
 func GetOrAdd(key string, meter Meter) Meter {
-	for {
-		if old := Get(key); old != nil {
-			return old
-		}
-
-		if Add(key, meter) {
-			return meter
-		}
-	}
+	return getDefaultPoller().GetOrAdd(key, meter)
 }
 
 // Remove removes any meters associated with the key which will no longer be
 // polled.
 func Remove(key string) {
-	DefaultPoller.Remove(key)
+	getDefaultPoller().Remove(key)
 }
 
 // Handle adds the given handler to the list of handlers to be executed after
 // polling the meters.
 func Handle(handler Handler) {
-	DefaultPoller.Handle(handler)
+	getDefaultPoller().Handle(handler)
+}
+
+// Group returns the group of meters of the DefaultPoller polled at the given
+// rate. Meters and handlers registered with the global functions are not part
+// of any group.
+func Group(rate time.Duration) *Poller {
+	return getDefaultPoller().Group(rate)
+}
+
+// Transform adds the given transformer to the list of transformers applied to
+// the polled values before they're dispatched to the handlers.
+func Transform(transformer Transformer) {
+	getDefaultPoller().Transform(transformer)
 }
 
 // Poll starts a background goroutine which will periodically poll the
 // registered meters at the given rate and prepend all the polled keys with the
 // given prefix.
 func Poll(prefix string, rate time.Duration) {
-	DefaultPoller.Poll(prefix, rate)
+	getDefaultPoller().Poll(prefix, rate)
+}
+
+// Stop stops the polling of the registered meters after polling them one last
+// time and waits for the handlers to drain their buffered values.
+func Stop(ctx context.Context) error {
+	return getDefaultPoller().Stop(ctx)
 }
@@ -0,0 +1,171 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter_test
+
+import (
+	"github.com/datacratic/gometer/meter"
+	"github.com/datacratic/gometer/meter/metertest"
+
+	"context"
+	"testing"
+	"time"
+)
+
+func WaitFor(t *testing.T, title string, cond func() bool) {
+	for deadline := time.Now().Add(1 * time.Second); !cond(); time.Sleep(1 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("FAIL(%s): timeout", title)
+		}
+	}
+}
+
+func TestPoller_Clock(t *testing.T) {
+	clock := metertest.NewClock(metertest.Epoch)
+	m0, m1, m2 := &meter.Gauge{Value: 1}, &meter.Gauge{Value: 2}, &meter.Gauge{Value: 3}
+	h0, h1 := &metertest.Recorder{}, &metertest.Recorder{}
+
+	poller := &meter.Poller{
+		Clock:    clock,
+		Meters:   map[string]meter.Meter{"m0": m0},
+		Handlers: []meter.Handler{h0},
+	}
+
+	poller.Poll("", 100*time.Millisecond)
+	defer poller.Stop(context.Background())
+
+	// expect advances the clock to the next poll once the poller is waiting on
+	// it and checks the values received by the handler.
+	expect := func(title string, handler *metertest.Recorder, n int, exp map[string]float64) {
+		WaitFor(t, title+"-wait", func() bool { return clock.Waiters() == 1 })
+		clock.Advance(100 * time.Millisecond)
+
+		WaitFor(t, title, func() bool { return len(handler.Batches()) == n })
+
+		for _, key := range []string{"m0", "m1", "m2"} {
+			if value, ok := exp[key]; ok {
+				handler.AssertValue(t, key, value, 0)
+			} else {
+				handler.AssertKeyAbsent(t, key)
+			}
+		}
+	}
+
+	expect("init", h0, 1, map[string]float64{"m0": 1})
+
+	poller.Add("m1", m1)
+	expect("add-m1", h0, 2, map[string]float64{"m0": 1, "m1": 2})
+
+	poller.Add("m2", m2)
+	expect("add-m2", h0, 3, map[string]float64{"m0": 1, "m1": 2, "m2": 3})
+
+	poller.Remove("m0")
+	expect("rmv-m0", h0, 4, map[string]float64{"m1": 2, "m2": 3})
+
+	poller.Remove("m2")
+	expect("rmv-m2", h0, 5, map[string]float64{"m1": 2})
+
+	poller.Add("m0", m0)
+	expect("add-m0", h0, 6, map[string]float64{"m0": 1, "m1": 2})
+
+	poller.Handle(h1)
+	expect("add-h1", h1, 1, map[string]float64{"m0": 1, "m1": 2})
+
+	WaitFor(t, "add-h1-h0", func() bool { return len(h0.Batches()) == 7 })
+	h0.AssertValue(t, "m0", 1, 0)
+	h0.AssertValue(t, "m1", 2, 0)
+}
+
+func TestPoller_Group(t *testing.T) {
+	clock := metertest.NewClock(metertest.Epoch)
+	fast, slow, later := &metertest.Recorder{}, &metertest.Recorder{}, &metertest.Recorder{}
+
+	poller := &meter.Poller{
+		Clock:    clock,
+		Meters:   map[string]meter.Meter{"m0": &meter.Gauge{Value: 1}},
+		Handlers: []meter.Handler{fast},
+	}
+
+	group := poller.Group(300 * time.Millisecond)
+	group.Add("m1", &meter.Gauge{Value: 2})
+	group.Handle(slow)
+
+	if poller.Group(300*time.Millisecond) != group {
+		t.Errorf("FAIL: expected the same group")
+	}
+
+	poller.Poll("p", 100*time.Millisecond)
+
+	// tick advances the clock by 100ms once all the pollers are waiting on it
+	// and waits for the expected number of polls of each handler.
+	tick := func(title string, pollers, nFast, nSlow, nLater int) {
+		WaitFor(t, title+"-wait", func() bool { return clock.Waiters() == pollers })
+		clock.Advance(100 * time.Millisecond)
+
+		WaitFor(t, title, func() bool {
+			return len(fast.Batches()) == nFast && len(slow.Batches()) == nSlow && len(later.Batches()) == nLater
+		})
+	}
+
+	tick("100ms", 2, 1, 0, 0)
+	tick("200ms", 2, 2, 0, 0)
+	tick("300ms", 2, 3, 1, 0)
+
+	fast.AssertValue(t, "p.m0", 1, 0)
+	slow.AssertValue(t, "p.m1", 2, 0)
+	fast.AssertKeyAbsent(t, "p.m1")
+
+	if sample, _ := slow.Get("p.m1"); !sample.Timestamp.Equal(metertest.Epoch.Add(300 * time.Millisecond)) {
+		t.Errorf("FAIL: unexpected group timestamp %s", sample.Timestamp)
+	}
+
+	// Groups created after Poll are started right away.
+	group = poller.Group(200 * time.Millisecond)
+	group.Handle(later)
+	group.Add("m2", &meter.Gauge{Value: 3})
+
+	tick("400ms", 3, 4, 1, 0)
+	tick("500ms", 3, 5, 1, 1)
+
+	later.AssertValue(t, "p.m2", 3, 0)
+
+	if err := poller.Stop(context.Background()); err != nil {
+		t.Errorf("FAIL: unexpected error: %s", err)
+	}
+
+	// Stop polls every group one last time after which nothing is polled.
+	clock.Advance(1 * time.Second)
+
+	if n, m, o := len(fast.Batches()), len(slow.Batches()), len(later.Batches()); n != 6 || m != 2 || o != 2 {
+		t.Errorf("FAIL: unexpected polls after stop fast=%d slow=%d later=%d", n, m, o)
+	}
+}
+
+func TestPoller_NoElapsed(t *testing.T) {
+	harness := metertest.NewHarness()
+
+	counter := &meter.Counter{}
+	harness.Poller.Add("c", counter)
+	harness.Poller.Poll("", 1*time.Hour)
+
+	counter.Count(10)
+	harness.Poll(1 * time.Second)
+	harness.Recorder.AssertCounterRate(t, "c", 10, 0)
+
+	// Meters are skipped until the clock moves forward such that their
+	// values are reported over the next non-empty interval.
+	counter.Count(5)
+	harness.Poll(0)
+	harness.Recorder.AssertKeyAbsent(t, "c")
+
+	if err := harness.Poller.Stop(context.Background()); err != nil {
+		t.Errorf("FAIL: unexpected error: %s", err)
+	}
+	harness.Recorder.AssertKeyAbsent(t, "c")
+
+	if n := len(harness.Recorder.Batches()); n != 3 {
+		t.Errorf("FAIL: batches %d != 3", n)
+	}
+
+	harness.Poll(500 * time.Millisecond)
+	harness.Recorder.AssertCounterRate(t, "c", 10, 0)
+}
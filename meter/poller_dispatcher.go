@@ -0,0 +1,185 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"github.com/datacratic/goklog/klog"
+
+	"context"
+	"time"
+)
+
+// DefaultHandlerQueueSize is used if QueueSize is not set in HandlerOptions.
+const DefaultHandlerQueueSize = 16
+
+// DispatchPolicy determines what happens when the values of a poll can't be
+// queued because the queue of a handler is full.
+type DispatchPolicy int
+
+const (
+	// DispatchDrop drops the values which couldn't be queued.
+	DispatchDrop DispatchPolicy = iota
+
+	// DispatchBlock blocks the poller until the values can be queued or
+	// until the Timeout of the handler expires in which case the values are
+	// dropped.
+	DispatchBlock
+)
+
+// HandlerOptions configures how polled values are dispatched to a handler.
+// Each handler is called from its own goroutine which consumes the values of
+// every poll from a bounded queue such that a slow handler doesn't delay the
+// other handlers or the poller.
+type HandlerOptions struct {
+
+	// QueueSize is the maximum number of polls queued for the handler.
+	// Defaults to DefaultHandlerQueueSize.
+	QueueSize int
+
+	// Policy determines what happens when the queue is full. Defaults to
+	// DispatchDrop.
+	Policy DispatchPolicy
+
+	// Timeout is the maximum amount of time the poller blocks on a full
+	// queue when Policy is DispatchBlock. A zero value blocks indefinitely.
+	Timeout time.Duration
+}
+
+// snapshotHandler is implemented by handlers which keep the last values they
+// received such that the values polled by the different pollers (eg. a poller
+// and its groups) sharing the handler don't replace each other.
+type snapshotHandler interface {
+	handleSnapshot(source *Poller, samples []Sample)
+}
+
+type dispatcher struct {
+	handler Handler
+	options HandlerOptions
+	dropped *CumulativeCounter
+	clock   Clock
+	source  *Poller
+
+	queueC chan []Sample
+	flushC chan chan struct{}
+	stopC  chan struct{}
+}
+
+func newDispatcher(handler Handler, options HandlerOptions, source *Poller, dropped *CumulativeCounter, clock Clock) *dispatcher {
+	if options.QueueSize == 0 {
+		options.QueueSize = DefaultHandlerQueueSize
+	}
+
+	dispatcher := &dispatcher{
+		handler: handler,
+		options: options,
+		dropped: dropped,
+		clock:   clock,
+		source:  source,
+		queueC:  make(chan []Sample, options.QueueSize),
+		flushC:  make(chan chan struct{}),
+		stopC:   make(chan struct{}),
+	}
+
+	go dispatcher.run()
+	return dispatcher
+}
+
+// Dispatch queues the given samples according to the policy of the handler.
+func (dispatcher *dispatcher) Dispatch(samples []Sample) {
+	select {
+	case dispatcher.queueC <- samples:
+		return
+	default:
+	}
+
+	if dispatcher.options.Policy == DispatchBlock {
+		var timeoutC <-chan time.Time
+
+		if dispatcher.options.Timeout > 0 {
+			timeoutC = dispatcher.clock.After(dispatcher.options.Timeout)
+		}
+
+		select {
+		case dispatcher.queueC <- samples:
+			return
+		case <-timeoutC:
+		}
+	}
+
+	dispatcher.dropped.Hit()
+	klog.KPrintf("meter.poller.dispatch.error", "queue full for handler %T: dropping %d values", dispatcher.handler, len(samples))
+}
+
+// Queue blocks until the given samples are queued regardless of the policy of
+// the handler or until the context is done in which case the samples are
+// dropped.
+func (dispatcher *dispatcher) Queue(ctx context.Context, samples []Sample) error {
+	select {
+	case dispatcher.queueC <- samples:
+		return nil
+
+	case <-ctx.Done():
+		dispatcher.dropped.Hit()
+		klog.KPrintf("meter.poller.dispatch.error", "context done for handler %T: dropping %d values", dispatcher.handler, len(samples))
+		return ctx.Err()
+	}
+}
+
+// Flush blocks until all the queued samples were handled or until the context
+// is done.
+func (dispatcher *dispatcher) Flush(ctx context.Context) error {
+	doneC := make(chan struct{})
+
+	select {
+	case dispatcher.flushC <- doneC:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-doneC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the goroutine of the dispatcher. Any values still queued are
+// dropped so Flush should be called first.
+func (dispatcher *dispatcher) Close() {
+	close(dispatcher.stopC)
+}
+
+func (dispatcher *dispatcher) run() {
+	for {
+		select {
+		case <-dispatcher.stopC:
+			return
+
+		case samples := <-dispatcher.queueC:
+			dispatcher.handle(samples)
+
+		case doneC := <-dispatcher.flushC:
+			for drained := false; !drained; {
+				select {
+				case samples := <-dispatcher.queueC:
+					dispatcher.handle(samples)
+				default:
+					drained = true
+				}
+			}
+			close(doneC)
+		}
+	}
+}
+
+// handle hands a private copy of the samples to the handler.
+func (dispatcher *dispatcher) handle(samples []Sample) {
+	if snapshot, ok := dispatcher.handler.(snapshotHandler); ok {
+		snapshot.handleSnapshot(dispatcher.source, append([]Sample(nil), samples...))
+	} else if sampler, ok := dispatcher.handler.(SampleHandler); ok {
+		sampler.HandleSamples(append([]Sample(nil), samples...))
+	} else {
+		dispatcher.handler.HandleMeters(FlattenSamples(samples))
+	}
+}
@@ -3,6 +3,10 @@
 package meter
 
 import (
+	"context"
+	"net/http/httptest"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -21,6 +25,7 @@ func TestPoller(t *testing.T) {
 	}
 
 	poller.Poll("", 100*time.Millisecond)
+	defer poller.Stop(context.Background())
 
 	h0.Expect("init", map[string]float64{"m0": 1})
 
@@ -43,3 +48,394 @@ func TestPoller(t *testing.T) {
 	h0.Expect("add-h1", map[string]float64{"m0": 1, "m1": 2})
 	h1.Expect("add-h1", map[string]float64{"m0": 1, "m1": 2})
 }
+
+func TestPoller_Stop(t *testing.T) {
+	counter := &Counter{}
+
+	handler := &TestHandler{T: t}
+	flusher := &TestFlusher{}
+
+	poller := &Poller{
+		Meters:   map[string]Meter{"c": counter},
+		Handlers: []Handler{handler, flusher},
+	}
+
+	poller.Poll("", 1*time.Hour)
+
+	counter.Count(10)
+	time.Sleep(100 * time.Millisecond)
+
+	if err := poller.Stop(context.Background()); err != nil {
+		t.Errorf("FAIL: unexpected error: %s", err)
+	}
+
+	// The final poll should be normalized over the ~100ms since the last poll
+	// and not over the nominal rate of an hour.
+	if value := handler.Get()["c"]; value < 10 || value > 100 {
+		t.Errorf("FAIL: unexpected final value %f", value)
+	}
+
+	if !flusher.flushed {
+		t.Errorf("FAIL: handler not flushed")
+	}
+}
+
+type TestFlusher struct{ flushed bool }
+
+func (flusher *TestFlusher) HandleMeters(map[string]float64) {}
+
+func (flusher *TestFlusher) Flush(context.Context) error {
+	flusher.flushed = true
+	return nil
+}
+
+func TestPoller_Dispatch(t *testing.T) {
+	blockC := make(chan struct{})
+
+	slow := HandlerFunc(func(map[string]float64) { <-blockC })
+	fast := &TestHandler{T: t}
+
+	poller := &Poller{
+		Meters:         map[string]Meter{"m0": &Gauge{Value: 1}},
+		Handlers:       []Handler{slow, fast},
+		HandlerOptions: HandlerOptions{QueueSize: 1},
+	}
+
+	poller.Poll("", 10*time.Millisecond)
+
+	defer poller.Stop(context.Background())
+	defer close(blockC)
+
+	// The slow handler holds one poll and has one more queued so every
+	// following poll is dropped while the other handlers are unaffected.
+	for i := 0; i < 5; i++ {
+		fast.Expect("fast", map[string]float64{"m0": 1})
+	}
+
+	doneC := make(chan struct{})
+	go func() {
+		poller.Add("m1", &Gauge{Value: 2})
+		close(doneC)
+	}()
+
+	select {
+	case <-doneC:
+	case <-time.After(1 * time.Second):
+		t.Fatal("FAIL: add blocked by slow handler")
+	}
+
+	fast.Expect("add-m1", map[string]float64{"m0": 1, "m1": 2})
+
+	if dropped := poller.Dropped.Total(); dropped == 0 {
+		t.Errorf("FAIL: expected dropped polls")
+	}
+}
+
+func TestPoller_DispatchBlock(t *testing.T) {
+	blockC := make(chan struct{})
+
+	handled := make(chan map[string]float64, 10)
+	slow := HandlerFunc(func(values map[string]float64) {
+		<-blockC
+		handled <- values
+	})
+
+	poller := &Poller{Meters: map[string]Meter{"m0": &Gauge{Value: 1}}}
+	poller.HandleWith(slow, HandlerOptions{QueueSize: 1, Policy: DispatchBlock, Timeout: 50 * time.Millisecond})
+
+	poller.poll(time.Second) // handled
+	poller.poll(time.Second) // queued
+
+	start := time.Now()
+	poller.poll(time.Second) // dropped after the timeout
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("FAIL: poll didn't block %s", elapsed)
+	}
+
+	if dropped := poller.Dropped.Total(); dropped != 1 {
+		t.Errorf("FAIL: dropped %d != 1", dropped)
+	}
+
+	close(blockC)
+
+	if err := poller.Stop(context.Background()); err != nil {
+		t.Errorf("FAIL: unexpected error: %s", err)
+	}
+
+	if n := len(handled); n != 2 {
+		t.Errorf("FAIL: handled %d != 2", n)
+	}
+}
+
+func TestPoller_StopFullQueue(t *testing.T) {
+	blockC := make(chan struct{})
+
+	handled := make(chan map[string]float64, 10)
+	slow := HandlerFunc(func(values map[string]float64) {
+		<-blockC
+		handled <- values
+	})
+
+	counter := &Counter{}
+
+	poller := &Poller{Meters: map[string]Meter{"c": counter}}
+	poller.HandleWith(slow, HandlerOptions{QueueSize: 1})
+	poller.Poll("", 1*time.Hour)
+
+	poller.poll(time.Second) // handled
+	poller.poll(time.Second) // queued
+
+	counter.Count(100)
+
+	// The final poll is queued behind the full queue instead of being dropped
+	// so Stop blocks until the slow handler catches up or the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := poller.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("FAIL: unexpected error: %v", err)
+	}
+
+	if dropped := poller.Dropped.Total(); dropped != 1 {
+		t.Errorf("FAIL: dropped %d != 1", dropped)
+	}
+
+	poller.Poll("", 1*time.Hour)
+	counter.Count(100)
+
+	errC := make(chan error)
+	go func() { errC <- poller.Stop(context.Background()) }()
+
+	close(blockC)
+
+	if err := <-errC; err != nil {
+		t.Errorf("FAIL: unexpected error: %s", err)
+	}
+
+	if dropped := poller.Dropped.Total(); dropped != 1 {
+		t.Errorf("FAIL: dropped %d != 1", dropped)
+	}
+
+	delivered := false
+	for n := len(handled); n > 0; n-- {
+		delivered = delivered || (<-handled)["c"] != 0
+	}
+
+	if !delivered {
+		t.Errorf("FAIL: final values not delivered")
+	}
+}
+
+func TestPoller_GroupSharedHandler(t *testing.T) {
+	prom := &PrometheusHandler{}
+	rest := &RESTHandler{}
+
+	poller := &Poller{
+		Meters:   map[string]Meter{"a": &Gauge{Value: 1}},
+		Handlers: []Handler{prom, rest},
+	}
+
+	group := poller.Group(1 * time.Minute)
+	group.Add("b", &Gauge{Value: 2})
+	group.Handle(prom)
+	group.Handle(rest)
+
+	poller.PollNow()
+	defer poller.Stop(context.Background())
+
+	// The values of the group don't replace the values of the poller.
+	recorder := httptest.NewRecorder()
+	prom.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, exp := range []string{"\na 1\n", "\nb 2\n"} {
+		if body := recorder.Body.String(); !strings.Contains(body, exp) {
+			t.Errorf("FAIL: missing %q in prometheus body\n%s", exp, body)
+		}
+	}
+
+	CheckValues(t, "rest", rest.Get(), map[string]float64{"a": 1, "b": 2})
+}
+
+func TestPoller_Restart(t *testing.T) {
+	handled := make(chan map[string]float64, 1)
+	blocking := HandlerFunc(func(values map[string]float64) { handled <- values })
+
+	poller := &Poller{Meters: map[string]Meter{"m0": &Gauge{Value: 1}}}
+	poller.HandleWith(blocking, HandlerOptions{QueueSize: 1, Policy: DispatchBlock})
+
+	goroutines := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		poller.Poll("", 1*time.Hour)
+		poller.Stop(context.Background())
+		<-handled
+	}
+
+	for deadline := time.Now().Add(1 * time.Second); runtime.NumGoroutine() > goroutines; time.Sleep(1 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("FAIL: leaked goroutines %d > %d", runtime.NumGoroutine(), goroutines)
+		}
+	}
+
+	// The dispatchers recreated by a restart keep the options of HandleWith.
+	poller.poll(1 * time.Second)
+	poller.poll(1 * time.Second)
+
+	if dispatcher := poller.dispatchers[0]; dispatcher.options.Policy != DispatchBlock || cap(dispatcher.queueC) != 1 {
+		t.Errorf("FAIL: options lost on restart %+v", dispatcher.options)
+	}
+
+	<-handled
+	<-handled
+	poller.Stop(context.Background())
+}
+
+func TestPoller_Transform(t *testing.T) {
+	mutator := HandlerFunc(func(values map[string]float64) {
+		values["a.b"] = -1
+		delete(values, "x.b")
+	})
+	h0 := &TestHandler{T: t}
+
+	poller := &Poller{
+		Meters:   map[string]Meter{"a.b": &Gauge{Value: 1}},
+		Handlers: []Handler{mutator, h0},
+	}
+	poller.Transform(NewTranslationHandler(map[string]string{"a.*": "x.{0}"}))
+
+	poller.poll(1 * time.Second)
+	poller.Stop(context.Background())
+
+	// The mutations of the first handler are not visible to the second
+	// handler while the translated keys are.
+	h0.Expect("transform", map[string]float64{"a.b": 1, "x.b": 1})
+}
+
+func TestPoller_TransformHandler(t *testing.T) {
+	h0 := &TestHandler{T: t}
+
+	poller := &Poller{Meters: map[string]Meter{"a.b": &Gauge{Value: 1}}}
+	poller.Handle(NewTranslationHandler(map[string]string{"a.*": "x.{0}"}))
+	poller.Handle(h0)
+
+	poller.poll(1 * time.Second)
+
+	// The translation is only applied as a transformer so only the other
+	// handler gets a dispatcher.
+	if n := len(poller.dispatchers); n != 1 || poller.dispatchers[0].handler != h0 {
+		t.Errorf("FAIL: unexpected dispatchers %d", n)
+	}
+
+	poller.Stop(context.Background())
+
+	// Translations registered as handlers are still seen by every handler.
+	h0.Expect("handle", map[string]float64{"a.b": 1, "x.b": 1})
+
+	// Handlers added after a transformer handler get their own dispatcher once
+	// the poller is restarted.
+	h1 := &TestHandler{T: t}
+	poller.Handle(h1)
+	poller.poll(1 * time.Second)
+	poller.Stop(context.Background())
+
+	h0.Expect("restart-h0", map[string]float64{"a.b": 1, "x.b": 1})
+	h1.Expect("restart-h1", map[string]float64{"a.b": 1, "x.b": 1})
+}
+
+func TestPoller_Schedule(t *testing.T) {
+	base := time.Unix(1000, 0)
+
+	check := func(title string, poller *Poller, prev, now, exp time.Duration) {
+		if next := poller.schedule(base.Add(prev), base.Add(now)); !next.Equal(base.Add(exp)) {
+			t.Errorf("FAIL(%s): next=%s != %s", title, next.Sub(base), exp)
+		}
+	}
+
+	ticker := &Poller{rate: 10 * time.Second}
+	check("ticker", ticker, 3*time.Second, 4*time.Second, 13*time.Second)
+	check("ticker-late", ticker, 3*time.Second, 25*time.Second, 33*time.Second)
+
+	aligned := &Poller{rate: 10 * time.Second, Align: true}
+	check("aligned", aligned, 0, 3*time.Second, 10*time.Second)
+	check("aligned-tick", aligned, 0, 10*time.Second, 20*time.Second)
+	check("aligned-late", aligned, 0, 37*time.Second, 40*time.Second)
+
+	jitter := &Poller{rate: 10 * time.Second, Align: true, offset: 2 * time.Second}
+	check("jitter", jitter, 0, 1*time.Second, 2*time.Second)
+	check("jitter-next", jitter, 0, 3*time.Second, 12*time.Second)
+}
+
+func TestPoller_Align(t *testing.T) {
+	rate := 100 * time.Millisecond
+	timestamps := make(chan time.Time, 10)
+
+	poller := &Poller{
+		Meters:   map[string]Meter{"m0": &Gauge{Value: 1}},
+		Align:    true,
+		Jitter:   20 * time.Millisecond,
+		Handlers: []Handler{sampleHandlerFunc(func(samples []Sample) { timestamps <- samples[0].Timestamp })},
+	}
+
+	poller.Poll("", rate)
+
+	if poller.offset < 0 || poller.offset >= poller.Jitter {
+		t.Errorf("FAIL: offset %s out of bounds", poller.offset)
+	}
+
+	for i := 0; i < 3; i++ {
+		ts := <-timestamps
+		if skew := ts.Sub(ts.Truncate(rate)) - poller.offset; skew < 0 || skew > 50*time.Millisecond {
+			t.Errorf("FAIL: poll %d not aligned %s", i, skew)
+		}
+	}
+
+	poller.Stop(context.Background())
+}
+
+func TestPoller_Elapsed(t *testing.T) {
+	a, b := &Counter{}, &Counter{}
+	batches := make(chan []Sample, 2)
+
+	poller := &Poller{
+		Meters:   map[string]Meter{"a": a},
+		Handlers: []Handler{sampleHandlerFunc(func(samples []Sample) { batches <- samples })},
+	}
+
+	poller.poll(1 * time.Second)
+
+	time.Sleep(50 * time.Millisecond)
+	poller.Add("b", b)
+	time.Sleep(50 * time.Millisecond)
+
+	a.Count(10)
+	b.Count(10)
+
+	poller.poll(1 * time.Second)
+	poller.Stop(context.Background())
+
+	if first := <-batches; len(first) != 0 {
+		t.Errorf("FAIL: unexpected first poll %v", first)
+	}
+
+	samples := make(map[string]Sample)
+	for _, sample := range <-batches {
+		samples[sample.Key] = sample
+	}
+
+	sa, sb := samples["a"], samples["b"]
+
+	if sa.Interval < 100*time.Millisecond || sa.Interval >= 1*time.Second {
+		t.Errorf("FAIL: unexpected interval for a %s", sa.Interval)
+	}
+
+	if sb.Interval < 50*time.Millisecond || sb.Interval >= sa.Interval {
+		t.Errorf("FAIL: unexpected interval for b %s", sb.Interval)
+	}
+
+	for _, sample := range []Sample{sa, sb} {
+		if exp := 10 * (float64(time.Second) / float64(sample.Interval)); sample.Value != exp {
+			t.Errorf("FAIL: %s=%g != %g", sample.Key, sample.Value, exp)
+		}
+	}
+}
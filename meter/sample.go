@@ -0,0 +1,135 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"strings"
+	"time"
+)
+
+// Kind indicates how the value of a sample was produced by its meter.
+type Kind int
+
+const (
+	// KindUntyped is used for values of meters and handlers which don't
+	// provide any type information.
+	KindUntyped Kind = iota
+
+	// KindCounter is the per second rate of events counted during the
+	// interval.
+	KindCounter
+
+	// KindGauge is a value which holds until it is changed. States are
+	// reported as gauges.
+	KindGauge
+
+	// KindHistogram is a statistic computed over the values of a histogram
+	// (eg. count, min, max, avg).
+	KindHistogram
+
+	// KindPercentile is a percentile computed over the values of a histogram
+	// where the last segment of the key identifies the percentile (eg. p99).
+	KindPercentile
+
+	// KindTotal is a monotonically increasing total which is not reset when
+	// the meter is read.
+	KindTotal
+)
+
+// String returns a textual representation of the kind.
+func (kind Kind) String() string {
+	switch kind {
+	case KindCounter:
+		return "counter"
+	case KindGauge:
+		return "gauge"
+	case KindHistogram:
+		return "histogram"
+	case KindPercentile:
+		return "percentile"
+	case KindTotal:
+		return "total"
+	}
+	return "untyped"
+}
+
+// Sample is a single value read from a meter along with its metadata.
+type Sample struct {
+
+	// Key is the key associated with the value without its labels.
+	Key string
+
+	// Labels are the dimensions associated with the value.
+	Labels Labels
+
+	// Value is the value read from the meter.
+	Value float64
+
+	// Kind indicates how the value was produced.
+	Kind Kind
+
+	// Unit is the optional unit of the value (eg. seconds).
+	Unit string
+
+	// Help is an optional description of the value.
+	Help string
+
+	// Timestamp is the time at which the meter was polled.
+	Timestamp time.Time
+
+	// Interval is the duration over which the value was normalized.
+	Interval time.Duration
+
+	// suffixLen is the length of the end of the key that should follow the
+	// labels when they are flattened (eg. histogram statistics).
+	suffixLen int
+}
+
+// FlatKey returns the key of the sample with its labels flattened into it. The
+// labels are inserted before any suffix added by the meter such that a sample
+// labeled with {"status": "500"} has the same key as a value recorded with the
+// "500" key in a multi meter.
+func (sample Sample) FlatKey() string {
+	if len(sample.Labels) == 0 {
+		return sample.Key
+	}
+
+	n := len(sample.Key) - sample.suffixLen
+	return Join(strings.TrimSuffix(sample.Key[:n], "."), sample.Labels.Flatten(), sample.Key[n:])
+}
+
+// FlattenSamples converts the given samples into a map of values where the
+// labels are flattened into the keys.
+func FlattenSamples(samples []Sample) map[string]float64 {
+	result := make(map[string]float64)
+
+	for _, sample := range samples {
+		result[sample.FlatKey()] = sample.Value
+	}
+
+	return result
+}
+
+func toSamples(values map[string]float64, kind Kind, unit, help string) []Sample {
+	var result []Sample
+
+	for key, value := range values {
+		result = append(result, Sample{Key: key, Value: value, Kind: kind, Unit: unit, Help: help})
+	}
+
+	return result
+}
+
+// newSamples adapts a map of values passed to HandleMeters for handlers that
+// implement the SampleHandler interface where the samples are timestamped using
+// the given clock.
+func newSamples(values map[string]float64, clock Clock) []Sample {
+	samples := toSamples(values, KindUntyped, "", "")
+
+	ts := clock.Now()
+	for i := range samples {
+		samples[i].Timestamp = ts
+	}
+
+	return samples
+}
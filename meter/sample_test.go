@@ -0,0 +1,86 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSample_FlatKey(t *testing.T) {
+	check := func(sample Sample, exp string) {
+		if key := sample.FlatKey(); key != exp {
+			t.Errorf("FAIL: flat key mismatch '%s' != '%s'", key, exp)
+		}
+	}
+
+	check(Sample{Key: "a.b"}, "a.b")
+	check(Sample{Key: "a", Labels: Labels{"x": "1", "y": "2"}}, "a.1.2")
+	check(Sample{Key: "a.p99", Labels: Labels{"x": "1"}, suffixLen: 3}, "a.1.p99")
+	check(Sample{Key: "p99", Labels: Labels{"x": "1"}, suffixLen: 3}, "1.p99")
+}
+
+func TestSample_Kinds(t *testing.T) {
+	dist := &Histogram{Unit: "seconds", Help: "latency"}
+	dist.RecordDuration(1 * time.Second)
+
+	for _, sample := range dist.ReadSamples(1 * time.Second) {
+		exp := KindHistogram
+		if _, ok := parsePercentile(sample.Key); ok {
+			exp = KindPercentile
+		}
+
+		if sample.Kind != exp || sample.Unit != "seconds" || sample.Help != "latency" {
+			t.Errorf("FAIL: unexpected sample %v", sample)
+		}
+	}
+
+	counter := &Counter{}
+	counter.Hit()
+
+	if samples := counter.ReadSamples(1 * time.Second); len(samples) != 1 || samples[0].Kind != KindCounter {
+		t.Errorf("FAIL: unexpected counter samples %v", samples)
+	}
+}
+
+func TestSample_Poller(t *testing.T) {
+	var counter Counter
+	counter.Count(10)
+
+	result := make(chan []Sample, 1)
+
+	poller := &Poller{
+		Meters:   map[string]Meter{"c": &counter},
+		Handlers: []Handler{sampleHandlerFunc(func(samples []Sample) { result <- samples })},
+	}
+	poller.poll(10 * time.Second)
+	poller.Stop(context.Background())
+
+	samples := <-result
+	if len(samples) != 1 {
+		t.Fatalf("FAIL: unexpected samples %v", samples)
+	}
+
+	sample := samples[0]
+	if sample.Key != "c" || sample.Value != 1 || sample.Kind != KindCounter {
+		t.Errorf("FAIL: unexpected sample %v", sample)
+	}
+
+	if sample.Interval != 10*time.Second || sample.Timestamp.IsZero() {
+		t.Errorf("FAIL: unexpected sample time %v %v", sample.Timestamp, sample.Interval)
+	}
+}
+
+func TestLoad_Tags(t *testing.T) {
+	var obj struct {
+		Latency *Histogram `unit:"seconds" help:"request latency"`
+	}
+
+	Load(&obj, "test.load.tags")
+	defer Unload(&obj, "test.load.tags")
+
+	if obj.Latency.Unit != "seconds" || obj.Latency.Help != "request latency" {
+		t.Errorf("FAIL: unexpected unit '%s' and help '%s'", obj.Latency.Unit, obj.Latency.Help)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// WriteTestCert writes a self-signed certificate valid for 127.0.0.1 which can
+// be used both as a server, a client and a CA certificate.
+func WriteTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("FATAL: unable to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "meter-test"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("FATAL: unable to create certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("FATAL: unable to marshal key: %s", err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("FATAL: unable to write certificate: %s", err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("FATAL: unable to write key: %s", err)
+	}
+
+	return
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meter-tls")
+	if err != nil {
+		t.Fatalf("FATAL: unable to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := WriteTestCert(t, dir)
+
+	config, err := NewTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatalf("FAIL: unable to create config: %s", err)
+	}
+
+	if len(config.Certificates) != 1 || config.RootCAs == nil {
+		t.Errorf("FAIL: incomplete config %v", config)
+	}
+
+	if _, err := NewTLSConfig("", "", keyFile); err == nil {
+		t.Errorf("FAIL: expected error for CA file without certificates")
+	}
+
+	if _, err := NewTLSConfig(certFile, "", ""); err == nil {
+		t.Errorf("FAIL: expected error for missing key file")
+	}
+}
+
+func TestCarbonHandler_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meter-tls")
+	if err != nil {
+		t.Fatalf("FATAL: unable to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := WriteTestCert(t, dir)
+
+	config, err := NewTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatalf("FATAL: unable to create config: %s", err)
+	}
+
+	// The server requires the client to present a certificate signed by our
+	// test CA which is also the server certificate.
+	serverConfig := &tls.Config{
+		Certificates: config.Certificates,
+		ClientCAs:    config.RootCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("FATAL: unable to listen: %s", err)
+	}
+	defer listener.Close()
+
+	lineC := make(chan string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lineC <- line
+	}()
+
+	// The dial timeout also covers the TLS handshake.
+	handler := &CarbonHandler{
+		URLs:        []string{listener.Addr().String()},
+		TLSConfig:   config,
+		DialTimeout: 1 * time.Second,
+	}
+	defer handler.Close()
+
+	handler.HandleSamples([]Sample{{Key: "a", Value: 1, Timestamp: time.Unix(100, 0)}})
+
+	select {
+	case line := <-lineC:
+		if line != "a 1 100\n" {
+			t.Errorf("FAIL: line mismatch '%s'", line)
+		}
+
+	case <-time.After(1 * time.Second):
+		t.Errorf("FAIL: timeout waiting for line")
+	}
+}
+
+func TestHTTPHandler_TLS(t *testing.T) {
+	config := &tls.Config{}
+
+	handler := &HTTPHandler{URL: "https://127.0.0.1", Method: "POST", TLSConfig: config}
+	handler.Init()
+
+	transport, ok := handler.HTTPClient.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig != config {
+		t.Fatalf("FAIL: TLS config not set on transport")
+	}
+
+	if transport.TLSHandshakeTimeout == 0 || transport.IdleConnTimeout == 0 || transport.DialContext == nil {
+		t.Errorf("FAIL: transport doesn't inherit the default timeouts")
+	}
+
+	if handler.HTTPClient.Timeout != DefaultHTTPTimeout {
+		t.Errorf("FAIL: client timeout %s != %s", handler.HTTPClient.Timeout, DefaultHTTPTimeout)
+	}
+}
@@ -10,13 +10,20 @@ var (
 	counterType      = reflect.TypeOf((*Counter)(nil))
 	counterMultiType = reflect.TypeOf((*MultiCounter)(nil))
 
+	cumulativeType      = reflect.TypeOf((*CumulativeCounter)(nil))
+	cumulativeMultiType = reflect.TypeOf((*MultiCumulativeCounter)(nil))
+
 	gaugeType      = reflect.TypeOf((*Gauge)(nil))
 	gaugeMultiType = reflect.TypeOf((*MultiGauge)(nil))
 
 	histogramType      = reflect.TypeOf((*Histogram)(nil))
 	histogramMultiType = reflect.TypeOf((*MultiHistogram)(nil))
+	sketchType         = reflect.TypeOf((*SketchHistogram)(nil))
 
 	stateType = reflect.TypeOf((*State)(nil))
+
+	gaugeFuncType      = reflect.TypeOf(GaugeFunc(nil))
+	gaugeMultiFuncType = reflect.TypeOf(MultiGaugeFunc(nil))
 )
 
 // Load crawls the given object to register and instantiate any pointer to
@@ -24,58 +31,111 @@ var (
 // field that contains the meter and will be prefixed by the given prefix
 // string. If a structure is encoutered then it will be recursively crawled with
 // the name of the field appended to the given prefix.
+//
+// The unit and help tags of a field are used to initialize the Unit and Help
+// members of newly created meters (eg. `unit:"seconds" help:"Request latency"`).
+//
+// Fields holding a non-nil func() float64 or func() map[string]float64 are
+// registered as a GaugeFunc or a MultiGaugeFunc respectively.
 func Load(obj interface{}, prefix string) {
+	getDefaultPoller().Load(obj, prefix)
+}
+
+// Load is similar to the global Load function but registers the meters with
+// the poller instead of the DefaultPoller.
+func (poller *Poller) Load(obj interface{}, prefix string) {
 
-	forEachMeter(reflect.ValueOf(obj), prefix, func(field reflect.Value, name string) {
+	forEachMeter(reflect.ValueOf(obj), prefix, func(field reflect.Value, tag reflect.StructTag, name string) {
 		switch field.Type() {
 
-		case counterType:
-			field.Set(reflect.ValueOf(GetCounter(name)))
-		case counterMultiType:
-			field.Set(reflect.ValueOf(GetMultiCounter(name)))
+		case counterType, counterMultiType,
+			cumulativeType, cumulativeMultiType,
+			gaugeType, gaugeMultiType,
+			histogramType, histogramMultiType, sketchType,
+			stateType:
 
-		case gaugeType:
-			field.Set(reflect.ValueOf(GetGauge(name)))
-		case gaugeMultiType:
-			field.Set(reflect.ValueOf(GetMultiGauge(name)))
+			field.Set(reflect.ValueOf(poller.GetOrAdd(name, newMeter(field.Type(), tag))))
 
-		case histogramType:
-			field.Set(reflect.ValueOf(GetHistogram(name)))
-		case histogramMultiType:
-			field.Set(reflect.ValueOf(GetMultiHistogram(name)))
-
-		case stateType:
-			field.Set(reflect.ValueOf(GetState(name)))
+		default:
+			if fn, ok := gaugeFunc(field); ok {
+				poller.GetOrAdd(name, fn)
+			}
 		}
 	})
 }
 
+// gaugeFunc converts a field holding a function that matches the signature of
+// GaugeFunc or MultiGaugeFunc into the equivalent meter.
+func gaugeFunc(field reflect.Value) (Meter, bool) {
+	if field.Kind() != reflect.Func || !field.CanInterface() || field.IsNil() {
+		return nil, false
+	}
+
+	switch {
+	case field.Type().ConvertibleTo(gaugeFuncType):
+		return field.Convert(gaugeFuncType).Interface().(GaugeFunc), true
+
+	case field.Type().ConvertibleTo(gaugeMultiFuncType):
+		return field.Convert(gaugeMultiFuncType).Interface().(MultiGaugeFunc), true
+	}
+
+	return nil, false
+}
+
+// newMeter instantiates a meter of the given pointer type and initializes its
+// Unit and Help members from the given field tag.
+func newMeter(typ reflect.Type, tag reflect.StructTag) Meter {
+	value := reflect.New(typ.Elem())
+
+	if unit := value.Elem().FieldByName("Unit"); unit.IsValid() {
+		unit.SetString(tag.Get("unit"))
+	}
+
+	if help := value.Elem().FieldByName("Help"); help.IsValid() {
+		help.SetString(tag.Get("help"))
+	}
+
+	return value.Interface().(Meter)
+}
+
 // Unload crawls the given object and deregisters any pointer to meters that it
 // finds. See Load for more details about the crawling and naming behaviour.
 func Unload(obj interface{}, prefix string) {
-	forEachMeter(reflect.ValueOf(obj), prefix, func(field reflect.Value, name string) {
+	getDefaultPoller().Unload(obj, prefix)
+}
+
+// Unload is similar to the global Unload function but deregisters the meters
+// from the poller instead of the DefaultPoller.
+func (poller *Poller) Unload(obj interface{}, prefix string) {
+	forEachMeter(reflect.ValueOf(obj), prefix, func(field reflect.Value, _ reflect.StructTag, name string) {
 		switch field.Type() {
 
 		case counterType:
 		case counterMultiType:
 
+		case cumulativeType:
+		case cumulativeMultiType:
+
 		case gaugeType:
 		case gaugeMultiType:
 
 		case histogramType:
 		case histogramMultiType:
+		case sketchType:
 
 		case stateType:
 
 		default:
-			return
+			if _, ok := gaugeFunc(field); !ok {
+				return
+			}
 		}
 
-		Remove(name)
+		poller.Remove(name)
 	})
 }
 
-func forEachMeter(value reflect.Value, prefix string, fn func(reflect.Value, string)) {
+func forEachMeter(value reflect.Value, prefix string, fn func(reflect.Value, reflect.StructTag, string)) {
 	if value.Kind() == reflect.Ptr {
 		value = value.Elem()
 	}
@@ -91,7 +151,7 @@ func forEachMeter(value reflect.Value, prefix string, fn func(reflect.Value, str
 		if field.Kind() == reflect.Struct {
 			forEachMeter(field, name, fn)
 		} else {
-			fn(field, name)
+			fn(field, fieldEntry.Tag, name)
 		}
 	}
 }